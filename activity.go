@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// maxRecentErrors is how many of the most recent errors are kept for the
+// status API.
+const maxRecentErrors = 20
+
+// pipelineActivity tracks the progress of the reader and the outputs, for
+// the systemd watchdog and the status API.
+var pipelineActivity = newActivity()
+
+func newActivity() *activity {
+	return &activity{
+		lastRead:   time.Now(),
+		writes:     map[int]time.Time{},
+		deliveries: map[string]time.Time{},
+		ready:      make(chan struct{}),
+	}
+}
+
+type activity struct {
+	mu sync.Mutex
+
+	lastRead time.Time
+	caughtUp bool
+
+	// ready is closed once the service is known to be working: when
+	// something has been delivered everywhere, or the reader caught up
+	// with the journal without finding anything to deliver.
+	ready chan struct{}
+
+	writes    map[int]time.Time
+	nextWrite int
+
+	// deliveries holds when each output last accepted a batch.
+	deliveries map[string]time.Time
+
+	pendingBatches    int
+	pendingRecords    int
+	maxPendingBatches int
+
+	cursor     string
+	lastCommit time.Time
+	shipped    uint64
+	lag        time.Duration
+	journalLag *Lag
+
+	errors []activityError
+}
+
+type activityError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// read records that the reader loop is still running.
+func (a *activity) read() {
+	a.mu.Lock()
+	a.lastRead = time.Now()
+	a.mu.Unlock()
+}
+
+// setCaughtUp records whether the reader has read everything in the
+// journal so far.
+func (a *activity) setCaughtUp(caughtUp bool) {
+	a.mu.Lock()
+	a.caughtUp = caughtUp
+	a.mu.Unlock()
+}
+
+// nothingToDeliver records that the reader has caught up with the journal
+// without sending anything on, so there won't be a delivery to show that
+// the service is working.
+func (a *activity) nothingToDeliver() {
+	a.mu.Lock()
+	a.setReadyLocked()
+	a.mu.Unlock()
+}
+
+func (a *activity) setReadyLocked() {
+	select {
+	case <-a.ready:
+	default:
+		close(a.ready)
+	}
+}
+
+func (a *activity) readyLocked() bool {
+	select {
+	case <-a.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// whenReady returns a channel that's closed once the service is ready.
+func (a *activity) whenReady() <-chan struct{} {
+	return a.ready
+}
+
+// setOutputs records the names of the outputs currently being written to,
+// forgetting any others.
+func (a *activity) setOutputs(names []string, maxPendingBatches int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	deliveries := map[string]time.Time{}
+	for _, name := range names {
+		deliveries[name] = a.deliveries[name]
+	}
+	a.deliveries = deliveries
+	a.maxPendingBatches = maxPendingBatches
+}
+
+// startWrite records that a write to an output has started, and returns a
+// function to call when it has finished.
+func (a *activity) startWrite() func() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := a.nextWrite
+	a.nextWrite++
+	a.writes[id] = time.Now()
+	return func() {
+		a.mu.Lock()
+		delete(a.writes, id)
+		a.mu.Unlock()
+	}
+}
+
+// delivered records that the named output has accepted a batch.
+func (a *activity) delivered(name string) {
+	a.mu.Lock()
+	a.deliveries[name] = time.Now()
+	a.mu.Unlock()
+}
+
+// setPending records the batches that are waiting to be written to every
+// output.
+func (a *activity) setPending(batches []*pendingBatch) {
+	records := 0
+	for _, batch := range batches {
+		records += len(batch.records)
+	}
+	a.mu.Lock()
+	a.pendingBatches = len(batches)
+	a.pendingRecords = records
+	a.mu.Unlock()
+}
+
+// acked records that a batch has been accepted by every output.
+func (a *activity) acked(cursor string, records []Record) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.cursor = cursor
+	a.lastCommit = time.Now()
+	a.setReadyLocked()
+	if len(records) == 0 {
+		return
+	}
+	lag := time.Since(records[len(records)-1].Time())
+	if lag < 0 {
+		lag = 0
+	}
+	a.shipped += uint64(len(records))
+	a.lag = lag
+}
+
+// committed returns the cursor of the last entry delivered to every
+// output.
+func (a *activity) committed() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.cursor
+}
+
+// setJournalLag records the lag last measured by the lag monitor.
+func (a *activity) setJournalLag(lag Lag) {
+	a.mu.Lock()
+	a.journalLag = &lag
+	a.mu.Unlock()
+}
+
+// failed records an error, keeping only the most recent ones.
+func (a *activity) failed(err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.errors = append(a.errors, activityError{time.Now(), err.Error()})
+	if len(a.errors) > maxRecentErrors {
+		a.errors = a.errors[len(a.errors)-maxRecentErrors:]
+	}
+}
+
+// progress returns the number of records accepted by every output so
+// far, and how far behind the journal the last of them was.
+func (a *activity) progress() (uint64, time.Duration) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.shipped, a.lag
+}
+
+// stalled returns an error if a write has been in progress for longer
+// than the limit, or the reader hasn't been active for that long even
+// though no writes are holding it up.
+func (a *activity) stalled(now time.Time, limit time.Duration) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stalledLocked(now, limit)
+}
+
+func (a *activity) stalledLocked(now time.Time, limit time.Duration) error {
+	for _, started := range a.writes {
+		if d := now.Sub(started); d > limit {
+			return fmt.Errorf("a write has been in progress for %s", d.Round(time.Second))
+		}
+	}
+	if d := now.Sub(a.lastRead); len(a.writes) == 0 && d > limit {
+		return fmt.Errorf("the journal hasn't been read for %s", d.Round(time.Second))
+	}
+	return nil
+}
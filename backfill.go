@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// BackfillOptions selects the journal entries to send again, and the
+// stream to send them to.
+type BackfillOptions struct {
+	JournalRange
+	LogGroupName  string
+	LogStreamName string
+}
+
+// BackfillReport describes what a backfill sent and skipped.
+type BackfillReport struct {
+	LogGroupName  string
+	LogStreamName string
+
+	Sent       eventSpan
+	Skipped    eventSpan
+	LastCursor string
+}
+
+// eventSpan counts events and the times of the first and last of them.
+type eventSpan struct {
+	Count       uint64
+	First, Last time.Time
+}
+
+func (s *eventSpan) add(t time.Time) {
+	s.merge(eventSpan{1, t, t})
+}
+
+// merge adds the events of a later span.
+func (s *eventSpan) merge(later eventSpan) {
+	if later.Count == 0 {
+		return
+	}
+	if s.Count == 0 {
+		s.First = later.First
+	}
+	s.Last = later.Last
+	s.Count += later.Count
+}
+
+// Backfill sends the journal entries in the given range to a Cloudwatch
+// Logs stream, with the configured filters and format, and then writes a
+// report of what was sent to w. The state file isn't used, so it can run
+// alongside the daemon. Events too old for Cloudwatch Logs to accept are
+// skipped and reported.
+func Backfill(w io.Writer, filename string, overrides []string, opts BackfillOptions) error {
+	config, err := LoadConfig(filename, overrides)
+	if err != nil {
+		return fmt.Errorf("error reading config: %s", err)
+	}
+
+	err = opts.JournalRange.Check()
+	if err != nil {
+		return err
+	}
+	if opts.LogGroupName == "" {
+		if config.LogGroupName == "" {
+			return fmt.Errorf("backfill requires -log-group when log_group isn't set")
+		}
+		opts.LogGroupName = config.LogGroupName
+	}
+	if opts.LogStreamName == "" {
+		// A stream of its own keeps the backfilled events from
+		// interleaving with the daemon's.
+		opts.LogStreamName = config.LogStreamName + "-backfill"
+	}
+
+	report := &BackfillReport{
+		LogGroupName:  opts.LogGroupName,
+		LogStreamName: opts.LogStreamName,
+	}
+	err = sendBackfill(config, opts, report)
+	writeBackfillReport(w, report)
+	return err
+}
+
+func sendBackfill(config *Config, opts BackfillOptions, report *BackfillReport) error {
+	cwClient := config.NewCloudWatchClient(config.NewAWSSession())
+	maxAge, err := maxAcceptedAge(cwClient, opts.LogGroupName)
+	if err != nil {
+		return fmt.Errorf("unable to describe log group %s: %s", opts.LogGroupName, err)
+	}
+
+	writer, err := NewWriter(
+		cwClient,
+		opts.LogGroupName,
+		opts.LogStreamName,
+		"",
+		config.Format,
+		config.UseSeqTokens,
+	)
+	if err != nil {
+		return fmt.Errorf("error initializing writer: %s", err)
+	}
+	type submittedBatch struct {
+		cursor string
+		span   eventSpan
+	}
+	var mu sync.Mutex
+	var submitted []submittedBatch
+	pipeline := NewPipeline(
+		[]LaneConfig{{
+			Sink:                 writer,
+			MaxRequestsPerSecond: config.MaxRequestsPerSecond,
+		}},
+		config.MaxConcurrentRequests,
+		config.MaxPendingBatches,
+		"",
+		func(cursor string) error {
+			// Only what's been written is reported as sent, in
+			// case a later batch fails.
+			mu.Lock()
+			defer mu.Unlock()
+			for len(submitted) > 0 {
+				b := submitted[0]
+				submitted = submitted[1:]
+				report.Sent.merge(b.span)
+				if b.cursor == cursor {
+					break
+				}
+			}
+			report.LastCursor = cursor
+			return nil
+		},
+	)
+
+	oldest := time.Now().Add(-maxAge + eventAgeMargin)
+	batch := make([]Record, 0, config.BufferSize)
+	var span eventSpan
+	submit := func() error {
+		mu.Lock()
+		submitted = append(submitted, submittedBatch{lastCursor(batch, ""), span})
+		mu.Unlock()
+		err := pipeline.Submit(batch)
+		batch, span = batch[:0], eventSpan{}
+		return err
+	}
+
+	err = ReadRange(config, opts.JournalRange, func(record *Record) error {
+		t := record.Time()
+		if t.Before(oldest) {
+			report.Skipped.add(t)
+			return nil
+		}
+		if len(batch) == cap(batch) || (len(batch) > 0 && t.Sub(batch[0].Time()) > maxBatchSpan) {
+			err := submit()
+			if err != nil {
+				return err
+			}
+		}
+		batch = append(batch, *record)
+		span.add(t)
+		return nil
+	})
+	if err == nil && len(batch) > 0 {
+		err = submit()
+	}
+
+	closeErr := pipeline.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func writeBackfillReport(w io.Writer, report *BackfillReport) {
+	if report.Sent.Count > 0 {
+		fmt.Fprintf(w, "Sent %d events to %s/%s, %s\n", report.Sent.Count, report.LogGroupName, report.LogStreamName, report.Sent.describe())
+	} else {
+		fmt.Fprintf(w, "Sent nothing to %s/%s\n", report.LogGroupName, report.LogStreamName)
+	}
+	if report.Skipped.Count > 0 {
+		fmt.Fprintf(w, "Skipped %d events too old for the log group, %s\n", report.Skipped.Count, report.Skipped.describe())
+	}
+	if report.LastCursor != "" {
+		fmt.Fprintf(w, "Last cursor sent: %s\n", report.LastCursor)
+	}
+}
+
+func (s eventSpan) describe() string {
+	return fmt.Sprintf("from %s to %s", s.First.Format(time.RFC3339), s.Last.Format(time.RFC3339))
+}
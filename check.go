@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	"github.com/hashicorp/hcl/hcl/ast"
+)
+
+// CheckConfig reads and resolves the config like LoadConfig, but also
+// reports settings that would otherwise be ignored, such as misspelled
+// ones. If there are no problems, the resolved config is written to w, with
+// its variables expanded.
+func CheckConfig(w io.Writer, filename string, overrides []string) error {
+	root, err := ReadConfigFiles(filename, overrides)
+	if err != nil {
+		return err
+	}
+
+	problems := checkConfigKeys(root, reflect.TypeOf(fileConfig{}), "")
+
+	config, err := ResolveConfig(root)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, "\n"))
+	}
+
+	for _, note := range configNotes(config) {
+		_, err = fmt.Fprintf(w, "# %s\n", note)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(FormatConfig(root))
+	return err
+}
+
+// configNotes returns remarks on a valid config, about settings that may
+// not work as expected. They're written as comments, so the output can
+// still be used as a config.
+func configNotes(config *Config) []string {
+	var notes []string
+	if config.LogGroupName != "" || len(config.Destinations) > 0 {
+		// The requests are split to keep within Cloudwatch Logs'
+		// limit on their size (see splitEvents).
+		average := maxBatchBytes/config.BufferSize - eventOverhead
+		if average < 1024 {
+			notes = append(notes, fmt.Sprintf("buffer_size = %d is an upper bound on the events in each Cloudwatch Logs request: batches whose events average more than %d bytes are split into requests of at most 1 MiB", config.BufferSize, average))
+		}
+	}
+	return notes
+}
+
+// checkConfigKeys returns a problem for each setting in the list that the
+// given config struct type doesn't have.
+func checkConfigKeys(list *ast.ObjectList, t reflect.Type, path string) []string {
+	fields := map[string]reflect.Type{}
+	addConfigFields(fields, t)
+
+	var problems []string
+	for _, item := range list.Items {
+		name := configKey(item.Keys[0])
+		itemPath := joinConfigPath(path, name)
+		fieldType, ok := fields[name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: unknown setting %s", item.Keys[0].Token.Pos, itemPath))
+			continue
+		}
+		problems = append(problems, checkConfigValue(item.Val, fieldType, itemPath)...)
+	}
+	return problems
+}
+
+func checkConfigValue(node ast.Node, t reflect.Type, path string) []string {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	obj, ok := node.(*ast.ObjectType)
+	if !ok {
+		// Decoding reports values of the wrong type.
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		return checkConfigKeys(obj.List, t, path)
+	case reflect.Map:
+		var problems []string
+		for _, item := range obj.List.Items {
+			itemPath := joinConfigPath(path, configKey(item.Keys[0]))
+			problems = append(problems, checkConfigValue(item.Val, t.Elem(), itemPath)...)
+		}
+		return problems
+	}
+	return nil
+}
+
+// addConfigFields adds the settings of the given struct type, by name,
+// including those of squashed embedded structs.
+func addConfigFields(fields map[string]reflect.Type, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("hcl"), ",")
+		if field.Anonymous && len(tag) > 1 && tag[1] == "squash" {
+			addConfigFields(fields, field.Type)
+			continue
+		}
+		if tag[0] != "" && tag[0] != "-" {
+			fields[tag[0]] = field.Type
+		}
+	}
+}
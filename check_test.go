@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigBufferSizeNote(t *testing.T) {
+	tests := []struct {
+		settings string
+		note     bool
+	}{
+		{`log_group = "group"`, false},
+		{"log_group = \"group\"\nbuffer_size = 500", false},
+		{"log_group = \"group\"\nbuffer_size = 5000", true},
+		{"file {\n    path = \"/tmp/out\"\n}\nbuffer_size = 50000", false},
+	}
+	for _, test := range tests {
+		filename := writeTestConfig(t, `
+aws_region = "eu-west-1"
+host_identity {
+    providers = ["hostname"]
+}
+%s
+`, test.settings)
+
+		var out bytes.Buffer
+		if err := CheckConfig(&out, filename, nil); err != nil {
+			t.Errorf("%q: %s", test.settings, err)
+			continue
+		}
+		note := strings.HasPrefix(out.String(), "# buffer_size")
+		if note != test.note {
+			t.Errorf("%q: noted buffer_size %v, want %v:\n%s", test.settings, note, test.note, out.String())
+		}
+	}
+}
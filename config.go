@@ -2,30 +2,155 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
+	"net/http"
 	"os"
-	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	awsCredentials "github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
 	"github.com/aws/aws-sdk-go/aws/ec2metadata"
 	awsSession "github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 
 	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
 )
 
 type Config struct {
 	AWSCredentials *awsCredentials.Credentials
 	AWSRegion      string
-	EC2InstanceId  string
-	LogGroupName   string
-	LogStreamName  string
-	LogPriority    Priority
-	StateFilename  string
-	JournalDir     string
-	BufferSize     int
+	AWSHTTPClient  *http.Client
+	AWSTLS         TLSConfig
+	AWSEndpoints   AWSEndpoints
+
+	// MetadataTimeout limits each request to the EC2 instance metadata
+	// service, so that hosts without one don't wait long to find out.
+	MetadataTimeout time.Duration
+
+	// MetadataTokenTTL is the lifetime of the IMDSv2 session tokens
+	// requested, and if MetadataV1Fallback is set then IMDSv1 requests
+	// are made when no token can be obtained.
+	MetadataTokenTTL   time.Duration
+	MetadataV1Fallback bool
+
+	InstanceId   string
+	HostIdentity *HostIdentity
+
+	// IdentityOffline is set if the config was loaded without consulting
+	// the instance metadata, when the ec2 identity provider would have
+	// been tried before the one that identified the host. The daemon may
+	// then identify the host differently, and so name its streams
+	// differently.
+	IdentityOffline bool
+
+	LogGroupName  string
+	LogStreamName string
+	UseSeqTokens  bool
+	LogPriority   Priority
+	StateFilename string
+	JournalDir    string
+	BufferSize    int
+	Format        string
+
+	// IncludeCursor adds each entry's journal cursor to its event, so
+	// that the event can be matched with the entry later.
+	IncludeCursor bool
+
+	// MetricsListen and StatusListen are the addresses to serve
+	// Prometheus metrics and the status API on, if any.
+	MetricsListen string
+	StatusListen  string
+
+	MaxConcurrentRequests int
+	MaxPendingBatches     int
+	MaxRequestsPerSecond  float64
+	Destinations          []*DestinationConfig
+
+	LagMetrics  *EMFOutputConfig
+	MetricRules *MetricRulesConfig
+
+	FileSink   *FileSinkConfig
+	SyslogSink *SyslogSinkConfig
+	LokiSink   *LokiSinkConfig
+	ESSink     *ElasticsearchSinkConfig
+	OTLPSink   *OTLPSinkConfig
+}
+
+// AWSEndpoints overrides the default endpoints of the AWS services we use,
+// e.g. to use VPC endpoints or a local stand-in for testing. Empty strings
+// mean the default endpoint.
+type AWSEndpoints struct {
+	CloudWatch  string
+	STS         string
+	EC2Metadata string
+}
+
+// DestinationConfig describes an additional Cloudwatch Logs stream that
+// every record is written to, alongside the one named by log_group and
+// log_stream.
+type DestinationConfig struct {
+	Name                 string
+	LogGroupName         string
+	LogStreamName        string
+	MaxRequestsPerSecond float64
+
+	// AWSCredentials are used instead of the main credentials when the
+	// destination assumes its own role.
+	AWSCredentials *awsCredentials.Credentials
+	Role           *AssumeRole
+}
+
+type FileSinkConfig struct {
+	Path           string
+	Format         string
+	MaxSize        int64
+	RotateInterval time.Duration
+	MaxFiles       int
+	Compress       bool
+}
+
+type SyslogSinkConfig struct {
+	Address          string
+	Protocol         string
+	Facility         int
+	StructuredDataId string
+	MaxRetries       int
+	TLS              TLSConfig
+}
+
+type LokiSinkConfig struct {
+	URL          string
+	Labels       []string
+	StaticLabels map[string]string
+	Encoding     string
+	Format       string
+	TenantId     string
+	MaxRetries   int
+	Auth         HTTPAuth
+	TLS          TLSConfig
+}
+
+type OTLPSinkConfig struct {
+	Endpoint    string
+	Protocol    string
+	Compression string
+	Headers     map[string]string
+	MaxRetries  int
+	TLS         TLSConfig
+}
+
+type ElasticsearchSinkConfig struct {
+	URL             string
+	Index           string
+	IndexDateFormat string
+	AWSSigV4        bool
+	AWSRegion       string
+	MaxRetries      int
+	Auth            HTTPAuth
+	TLS             TLSConfig
 }
 
 type fileConfig struct {
@@ -33,10 +158,108 @@ type fileConfig struct {
 	EC2InstanceId string `hcl:"ec2_instance_id"`
 	LogGroupName  string `hcl:"log_group"`
 	LogStreamName string `hcl:"log_stream"`
+	UseSeqTokens  bool   `hcl:"sequence_tokens"`
 	LogPriority   string `hcl:"log_priority"`
 	StateFilename string `hcl:"state_file"`
 	JournalDir    string `hcl:"journal_dir"`
 	BufferSize    int    `hcl:"buffer_size"`
+	Format        string `hcl:"format"`
+	IncludeCursor bool   `hcl:"include_cursor"`
+
+	StrictVariables bool   `hcl:"strict_variables"`
+	MetricsListen   string `hcl:"metrics_listen"`
+	StatusListen    string `hcl:"status_listen"`
+
+	MaxConcurrentRequests int      `hcl:"max_concurrent_requests"`
+	MaxPendingBatches     int      `hcl:"max_pending_batches"`
+	MaxRequestsPerSecond  *float64 `hcl:"max_requests_per_second"`
+
+	CloudWatchEndpoint    string `hcl:"cloudwatch_endpoint"`
+	STSEndpoint           string `hcl:"sts_endpoint"`
+	EC2MetadataEndpoint   string `hcl:"ec2_metadata_endpoint"`
+	AWSCABundle           string `hcl:"aws_ca_bundle"`
+	AWSInsecureSkipVerify bool   `hcl:"aws_insecure_skip_verify"`
+	EC2MetadataTokenTTL   string `hcl:"ec2_metadata_token_ttl"`
+	EC2MetadataV1Fallback bool   `hcl:"ec2_metadata_v1_fallback"`
+
+	AWSProfile           string `hcl:"aws_profile"`
+	WebIdentityTokenFile string `hcl:"web_identity_token_file"`
+	roleConfig           `hcl:",squash"`
+
+	Destinations map[string]*destinationConfig `hcl:"cloudwatch"`
+	HostIdentity *hostIdentityConfig           `hcl:"host_identity"`
+	LagMetrics   *emfOutputConfig              `hcl:"lag_metrics"`
+	MetricRules  *metricRulesConfig            `hcl:"metric_rules"`
+
+	FileSink   *fileSinkConfig   `hcl:"file"`
+	SyslogSink *syslogSinkConfig `hcl:"syslog"`
+	LokiSink   *lokiSinkConfig   `hcl:"loki"`
+	ESSink     *esSinkConfig     `hcl:"elasticsearch"`
+	OTLPSink   *otlpSinkConfig   `hcl:"otlp"`
+}
+
+type destinationConfig struct {
+	LogGroupName         string   `hcl:"log_group"`
+	LogStreamName        string   `hcl:"log_stream"`
+	MaxRequestsPerSecond *float64 `hcl:"max_requests_per_second"`
+
+	roleConfig `hcl:",squash"`
+}
+
+type fileSinkConfig struct {
+	Path           string `hcl:"path"`
+	Format         string `hcl:"format"`
+	MaxSize        string `hcl:"max_size"`
+	RotateInterval string `hcl:"rotate_interval"`
+	MaxFiles       int    `hcl:"max_files"`
+	Compress       bool   `hcl:"compress"`
+}
+
+type syslogSinkConfig struct {
+	Address          string `hcl:"address"`
+	Protocol         string `hcl:"protocol"`
+	Facility         string `hcl:"facility"`
+	StructuredDataId string `hcl:"structured_data_id"`
+	MaxRetries       *int   `hcl:"max_retries"`
+	tlsConfig        `hcl:",squash"`
+}
+
+type lokiSinkConfig struct {
+	URL            string            `hcl:"url"`
+	Labels         []string          `hcl:"labels"`
+	StaticLabels   map[string]string `hcl:"static_labels"`
+	Encoding       string            `hcl:"encoding"`
+	Format         string            `hcl:"format"`
+	TenantId       string            `hcl:"tenant_id"`
+	MaxRetries     *int              `hcl:"max_retries"`
+	httpAuthConfig `hcl:",squash"`
+	tlsConfig      `hcl:",squash"`
+}
+
+type otlpSinkConfig struct {
+	Endpoint    string            `hcl:"endpoint"`
+	Protocol    string            `hcl:"protocol"`
+	Compression string            `hcl:"compression"`
+	Headers     map[string]string `hcl:"headers"`
+	MaxRetries  *int              `hcl:"max_retries"`
+	tlsConfig   `hcl:",squash"`
+}
+
+type esSinkConfig struct {
+	URL             string  `hcl:"url"`
+	Index           string  `hcl:"index"`
+	IndexDateFormat *string `hcl:"index_date_format"`
+	AWSSigV4        bool    `hcl:"aws_sigv4"`
+	AWSRegion       string  `hcl:"aws_region"`
+	MaxRetries      *int    `hcl:"max_retries"`
+	httpAuthConfig  `hcl:",squash"`
+	tlsConfig       `hcl:",squash"`
+}
+
+// hasSinks returns true if any output other than the log_group stream is
+// configured, in which case log_group becomes optional.
+func (c *fileConfig) hasSinks() bool {
+	return len(c.Destinations) > 0 || c.MetricRules != nil || c.FileSink != nil || c.SyslogSink != nil || c.LokiSink != nil || c.ESSink != nil || c.OTLPSink != nil
 }
 
 func getLogLevel(priority string) (Priority, error) {
@@ -61,49 +284,151 @@ func getLogLevel(priority string) (Priority, error) {
 	return DEBUG, fmt.Errorf("'%s' is unsupported log priority", priority)
 }
 
-func LoadConfig(filename string) (*Config, error) {
-	configBytes, err := ioutil.ReadFile(filename)
+// LoadConfig reads the config from the given file or directory, with the
+// given overrides applied (see ReadConfigFiles).
+func LoadConfig(filename string, overrides []string) (*Config, error) {
+	root, err := ReadConfigFiles(filename, overrides)
+	if err != nil {
+		return nil, err
+	}
+	return ResolveConfig(root)
+}
+
+// LoadConfigOffline loads the config like LoadConfig, but without
+// consulting the EC2 instance metadata service, so the host must be
+// identified by another provider. The region is left empty if it can't be
+// found without the metadata, and no AWS credentials are loaded.
+func LoadConfigOffline(filename string, overrides []string) (*Config, error) {
+	root, err := ReadConfigFiles(filename, overrides)
+	if err != nil {
+		return nil, err
+	}
+	return resolveConfig(root, true, false)
+}
+
+// LoadConfigForAWS loads the config like LoadConfigOffline, but with the
+// AWS credentials loaded, for commands that call AWS APIs but can be told
+// which streams to use, and so needn't identify the host as the daemon
+// would.
+func LoadConfigForAWS(filename string, overrides []string) (*Config, error) {
+	root, err := ReadConfigFiles(filename, overrides)
 	if err != nil {
 		return nil, err
 	}
+	return resolveConfig(root, true, true)
+}
 
+// loadConfigFor loads the config for a command that only contacts AWS when
+// asked to.
+func loadConfigFor(filename string, overrides []string, queryAWS bool) (*Config, error) {
+	if queryAWS {
+		return LoadConfig(filename, overrides)
+	}
+	return LoadConfigOffline(filename, overrides)
+}
+
+// ResolveConfig checks and resolves the config read by ReadConfigFiles,
+// identifying the host and expanding the variables in the config in place.
+func ResolveConfig(root *ast.ObjectList) (*Config, error) {
+	return resolveConfig(root, false, true)
+}
+
+// resolveConfig resolves the config, only consulting the instance metadata
+// to identify the host unless offline is set, and loading AWS credentials
+// if credentials is set.
+func resolveConfig(root *ast.ObjectList, offline, credentials bool) (*Config, error) {
 	var fConfig fileConfig
-	err = hcl.Decode(&fConfig, string(configBytes))
+	err := hcl.DecodeObject(&fConfig, root)
 	if err != nil {
 		return nil, err
 	}
 
-	if fConfig.LogGroupName == "" {
+	if fConfig.LogGroupName == "" && !fConfig.hasSinks() {
 		return nil, fmt.Errorf("log_group is required")
 	}
 	if fConfig.StateFilename == "" {
 		return nil, fmt.Errorf("state_file is required")
 	}
 
-	metaClient := ec2metadata.New(awsSession.New(&aws.Config{}))
+	config := &Config{
+		AWSTLS: TLSConfig{
+			CAFile:             fConfig.AWSCABundle,
+			InsecureSkipVerify: fConfig.AWSInsecureSkipVerify,
+		},
+		AWSEndpoints: AWSEndpoints{
+			CloudWatch:  fConfig.CloudWatchEndpoint,
+			STS:         fConfig.STSEndpoint,
+			EC2Metadata: fConfig.EC2MetadataEndpoint,
+		},
+	}
 
-	expandFileConfig(&fConfig, metaClient)
+	if config.AWSTLS != (TLSConfig{}) {
+		// Otherwise the SDK's own client is used.
+		config.AWSHTTPClient, err = newAWSHTTPClient(config.AWSTLS, 0)
+		if err != nil {
+			return nil, fmt.Errorf("invalid aws_ca_bundle: %s", err)
+		}
+	}
 
-	config := &Config{}
+	identityConfig, err := loadHostIdentityConfig(fConfig.HostIdentity, fConfig.EC2InstanceId)
+	if err != nil {
+		return nil, fmt.Errorf("host_identity: %s", err)
+	}
+	config.MetadataTimeout = identityConfig.MetadataTimeout
 
-	if fConfig.AWSRegion != "" {
-		config.AWSRegion = fConfig.AWSRegion
+	if fConfig.EC2MetadataTokenTTL != "" {
+		config.MetadataTokenTTL, err = time.ParseDuration(fConfig.EC2MetadataTokenTTL)
+		if err != nil || config.MetadataTokenTTL < time.Second || config.MetadataTokenTTL > 6*time.Hour {
+			return nil, fmt.Errorf("ec2_metadata_token_ttl must be a duration between 1s and 6h")
+		}
 	} else {
-		region, err := metaClient.Region()
+		config.MetadataTokenTTL = defaultIMDSTokenTTL
+	}
+	config.MetadataV1Fallback = fConfig.EC2MetadataV1Fallback
+
+	var metaClient *ec2metadata.EC2Metadata
+	if !offline {
+		metaClient, err = config.NewMetadataClient()
 		if err != nil {
-			return nil, fmt.Errorf("unable to detect AWS region: %s", err)
+			return nil, err
 		}
-		config.AWSRegion = region
 	}
 
-	if fConfig.EC2InstanceId != "" {
-		config.EC2InstanceId = fConfig.EC2InstanceId
-	} else {
-		instanceId, err := metaClient.GetMetadata("instance-id")
-		if err != nil {
-			return nil, fmt.Errorf("unable to detect EC2 instance id: %s", err)
+	identityProviders, err := newIdentityProviders(identityConfig, metaClient)
+	if err != nil {
+		return nil, fmt.Errorf("host_identity: %s", err)
+	}
+	config.HostIdentity, err = DetectHostIdentity(identityProviders)
+	if err != nil {
+		return nil, err
+	}
+	if identityConfig.EC2InstanceId != "" {
+		config.HostIdentity.overrideInstanceId(identityConfig.EC2InstanceId)
+	}
+	config.InstanceId = config.HostIdentity.InstanceId
+	if offline {
+		config.IdentityOffline = skippedEC2Identity(identityConfig, config.HostIdentity)
+	}
+
+	expander := newConfigExpander(config.HostIdentity, metaClient, fConfig.StrictVariables)
+	err = expandConfigTree(root, expander)
+	if err != nil {
+		return nil, err
+	}
+	fConfig = fileConfig{}
+	err = hcl.DecodeObject(&fConfig, root)
+	if err != nil {
+		return nil, err
+	}
+
+	if fConfig.AWSRegion != "" {
+		config.AWSRegion = fConfig.AWSRegion
+	} else if fConfig.LogGroupName != "" || len(fConfig.Destinations) > 0 || fConfig.LagMetrics != nil || fConfig.MetricRules != nil || (fConfig.ESSink != nil && fConfig.ESSink.AWSSigV4) {
+		region, err := detectRegion(config.HostIdentity, identityConfig, metaClient)
+		if err != nil && !offline {
+			return nil, fmt.Errorf("unable to detect AWS region: %s", err)
 		}
-		config.EC2InstanceId = instanceId
+		config.AWSRegion = region
 	}
 
 	if fConfig.LogPriority == "" {
@@ -122,120 +447,593 @@ func LoadConfig(filename string) (*Config, error) {
 		config.LogStreamName = fConfig.LogStreamName
 	} else {
 		// By default we use the instance id as the stream name.
-		config.LogStreamName = config.EC2InstanceId
+		config.LogStreamName = config.InstanceId
 	}
 
+	config.UseSeqTokens = fConfig.UseSeqTokens
 	config.StateFilename = fConfig.StateFilename
 	config.JournalDir = fConfig.JournalDir
+	config.MetricsListen = fConfig.MetricsListen
+	config.StatusListen = fConfig.StatusListen
 
-	if fConfig.BufferSize != 0 {
+	if fConfig.BufferSize < 0 {
+		return nil, fmt.Errorf("buffer_size must not be negative")
+	} else if fConfig.BufferSize > maxBatchEvents && (fConfig.LogGroupName != "" || len(fConfig.Destinations) > 0) {
+		return nil, fmt.Errorf("buffer_size can't be more than %d, the most events Cloudwatch Logs accepts at once", maxBatchEvents)
+	} else if fConfig.BufferSize != 0 {
 		config.BufferSize = fConfig.BufferSize
 	} else {
 		config.BufferSize = 100
 	}
 
-	config.AWSCredentials = awsCredentials.NewChainCredentials([]awsCredentials.Provider{
-		&awsCredentials.EnvProvider{},
-		&ec2rolecreds.EC2RoleProvider{
-			Client: metaClient,
-		},
-	})
+	if fConfig.MaxConcurrentRequests < 0 {
+		return nil, fmt.Errorf("max_concurrent_requests must not be negative")
+	} else if fConfig.MaxConcurrentRequests != 0 {
+		config.MaxConcurrentRequests = fConfig.MaxConcurrentRequests
+	} else {
+		config.MaxConcurrentRequests = 4
+	}
+
+	if fConfig.MaxPendingBatches < 0 {
+		return nil, fmt.Errorf("max_pending_batches must not be negative")
+	} else if fConfig.MaxPendingBatches != 0 {
+		config.MaxPendingBatches = fConfig.MaxPendingBatches
+	} else {
+		config.MaxPendingBatches = 10
+	}
+
+	config.MaxRequestsPerSecond, err = loadRequestRate(fConfig.MaxRequestsPerSecond)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(fConfig.Destinations))
+	for name := range fConfig.Destinations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		dest, err := loadDestinationConfig(name, fConfig.Destinations[name], config.InstanceId)
+		if err != nil {
+			return nil, fmt.Errorf("cloudwatch %q: %s", name, err)
+		}
+		config.Destinations = append(config.Destinations, dest)
+	}
+
+	if fConfig.Format != "" {
+		config.Format = fConfig.Format
+	} else {
+		config.Format = "json"
+	}
+	if _, err := GetEncoder(config.Format); err != nil {
+		return nil, err
+	}
+	config.IncludeCursor = fConfig.IncludeCursor
+
+	if fConfig.LagMetrics != nil {
+		config.LagMetrics, err = fConfig.LagMetrics.resolve(config.LogGroupName, config.LogStreamName, "-metrics")
+		if err != nil {
+			return nil, fmt.Errorf("lag_metrics: %s", err)
+		}
+	}
+
+	if fConfig.MetricRules != nil {
+		config.MetricRules, err = loadMetricRulesConfig(fConfig.MetricRules, config.LogGroupName, config.LogStreamName)
+		if err != nil {
+			return nil, fmt.Errorf("metric_rules: %s", err)
+		}
+	}
+
+	if fConfig.FileSink != nil {
+		config.FileSink, err = loadFileSinkConfig(fConfig.FileSink, config.Format)
+		if err != nil {
+			return nil, fmt.Errorf("file: %s", err)
+		}
+	}
+
+	if fConfig.SyslogSink != nil {
+		config.SyslogSink, err = loadSyslogSinkConfig(fConfig.SyslogSink)
+		if err != nil {
+			return nil, fmt.Errorf("syslog: %s", err)
+		}
+	}
+
+	if fConfig.LokiSink != nil {
+		config.LokiSink, err = loadLokiSinkConfig(fConfig.LokiSink, config.Format)
+		if err != nil {
+			return nil, fmt.Errorf("loki: %s", err)
+		}
+	}
+
+	if fConfig.ESSink != nil {
+		config.ESSink, err = loadESSinkConfig(fConfig.ESSink, config.AWSRegion)
+		if err != nil {
+			return nil, fmt.Errorf("elasticsearch: %s", err)
+		}
+	}
+
+	if fConfig.OTLPSink != nil {
+		config.OTLPSink, err = loadOTLPSinkConfig(fConfig.OTLPSink)
+		if err != nil {
+			return nil, fmt.Errorf("otlp: %s", err)
+		}
+	}
+
+	if !credentials {
+		return config, nil
+	}
+
+	if metaClient == nil {
+		// The instance metadata may still provide credentials.
+		metaClient, err = config.NewMetadataClient()
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = config.loadCredentials(&fConfig, metaClient)
+	if err != nil {
+		return nil, err
+	}
+	for _, dest := range config.Destinations {
+		if dest.Role != nil {
+			dest.AWSCredentials = config.assumeRole(config.AWSCredentials, dest.Role)
+		}
+	}
+
+	return config, nil
+}
+
+// skippedEC2Identity returns whether the ec2 provider comes before the one
+// that identified the host, so that it would have been used had the
+// instance metadata been available.
+func skippedEC2Identity(config *HostIdentityConfig, identity *HostIdentity) bool {
+	for _, name := range config.Providers {
+		if name == identity.Provider {
+			return false
+		}
+		if name == "ec2" {
+			return true
+		}
+	}
+	return false
+}
+
+// loadHostIdentityConfig returns the host_identity settings. For
+// compatibility, ec2_instance_id is a default for instance_id.
+func loadHostIdentityConfig(fConfig *hostIdentityConfig, ec2InstanceId string) (*HostIdentityConfig, error) {
+	if fConfig == nil {
+		fConfig = &hostIdentityConfig{}
+	}
+
+	config := &HostIdentityConfig{
+		Providers:  fConfig.Providers,
+		InstanceId: fConfig.InstanceId,
+		Region:     fConfig.Region,
+		Attributes: fConfig.Attributes,
+	}
+	if len(config.Providers) == 0 {
+		config.Providers = defaultIdentityProviders
+	}
+	if config.InstanceId == "" {
+		config.EC2InstanceId = ec2InstanceId
+	}
+
+	if fConfig.MetadataTimeout != "" {
+		var err error
+		config.MetadataTimeout, err = time.ParseDuration(fConfig.MetadataTimeout)
+		if err != nil || config.MetadataTimeout <= 0 {
+			return nil, fmt.Errorf("'%s' is not a valid metadata_timeout", fConfig.MetadataTimeout)
+		}
+	} else {
+		config.MetadataTimeout = time.Second
+	}
+
+	return config, nil
+}
+
+// detectRegion returns the region of the host, if the identity provider
+// didn't know it. This still works on EC2 when the instance id was given
+// in the config.
+func detectRegion(identity *HostIdentity, config *HostIdentityConfig, metaClient *ec2metadata.EC2Metadata) (string, error) {
+	if identity.Region != "" {
+		return identity.Region, nil
+	}
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region, nil
+	}
+	for _, name := range config.Providers {
+		if name == "ec2" && identity.Provider != "ec2" && metaClient != nil {
+			return metaClient.Region()
+		}
+	}
+	return "", fmt.Errorf("%s doesn't know the region; set aws_region", identity.Provider)
+}
+
+func loadDestinationConfig(name string, fConfig *destinationConfig, instanceId string) (*DestinationConfig, error) {
+	if fConfig.LogGroupName == "" {
+		return nil, fmt.Errorf("log_group is required")
+	}
+
+	config := &DestinationConfig{
+		Name:          name,
+		LogGroupName:  fConfig.LogGroupName,
+		LogStreamName: fConfig.LogStreamName,
+	}
+	if config.LogStreamName == "" {
+		config.LogStreamName = instanceId
+	}
+
+	var err error
+	config.MaxRequestsPerSecond, err = loadRequestRate(fConfig.MaxRequestsPerSecond)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Role, err = fConfig.roleConfig.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// loadRequestRate returns the given max_requests_per_second setting, or
+// the default of 5, which was the Cloudwatch Logs limit on PutLogEvents
+// requests to each stream.
+func loadRequestRate(rate *float64) (float64, error) {
+	if rate == nil {
+		return 5, nil
+	}
+	if *rate < 0 {
+		return 0, fmt.Errorf("max_requests_per_second must not be negative")
+	}
+	return *rate, nil
+}
+
+func loadFileSinkConfig(fConfig *fileSinkConfig, defaultFormat string) (*FileSinkConfig, error) {
+	if fConfig.Path == "" {
+		return nil, fmt.Errorf("path is required")
+	}
+
+	config := &FileSinkConfig{
+		Path:     fConfig.Path,
+		Format:   fConfig.Format,
+		MaxFiles: fConfig.MaxFiles,
+		Compress: fConfig.Compress,
+	}
+
+	if config.Format == "" {
+		config.Format = defaultFormat
+	}
+	if _, err := GetEncoder(config.Format); err != nil {
+		return nil, err
+	}
+
+	if fConfig.MaxSize != "" {
+		size, err := parseByteSize(fConfig.MaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max_size: %s", err)
+		}
+		config.MaxSize = size
+	} else {
+		config.MaxSize = 100 << 20
+	}
+
+	if fConfig.RotateInterval != "" {
+		interval, err := time.ParseDuration(fConfig.RotateInterval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rotate_interval: %s", err)
+		}
+		config.RotateInterval = interval
+	}
+
+	if config.MaxFiles < 0 {
+		return nil, fmt.Errorf("max_files must not be negative")
+	}
+
+	return config, nil
+}
+
+func loadSyslogSinkConfig(fConfig *syslogSinkConfig) (*SyslogSinkConfig, error) {
+	if fConfig.Address == "" {
+		return nil, fmt.Errorf("address is required")
+	}
+
+	config := &SyslogSinkConfig{
+		Address:          fConfig.Address,
+		Protocol:         fConfig.Protocol,
+		StructuredDataId: fConfig.StructuredDataId,
+		MaxRetries:       5,
+	}
+
+	switch config.Protocol {
+	case "":
+		config.Protocol = "tcp"
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("'%s' is not a supported protocol", config.Protocol)
+	}
+
+	if fConfig.Facility != "" {
+		facility, err := getSyslogFacility(fConfig.Facility)
+		if err != nil {
+			return nil, err
+		}
+		config.Facility = facility
+	} else {
+		config.Facility = syslogFacilities["user"]
+	}
+
+	if config.StructuredDataId == "" {
+		config.StructuredDataId = "journald@32473"
+	}
+
+	if fConfig.MaxRetries != nil {
+		if *fConfig.MaxRetries < 0 {
+			return nil, fmt.Errorf("max_retries must not be negative")
+		}
+		config.MaxRetries = *fConfig.MaxRetries
+	}
+
+	tls, err := fConfig.tlsConfig.resolve()
+	if err != nil {
+		return nil, err
+	}
+	config.TLS = tls
+
+	return config, nil
+}
+
+func loadLokiSinkConfig(fConfig *lokiSinkConfig, defaultFormat string) (*LokiSinkConfig, error) {
+	if fConfig.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+
+	config := &LokiSinkConfig{
+		URL:          strings.TrimSuffix(fConfig.URL, "/"),
+		Labels:       fConfig.Labels,
+		StaticLabels: fConfig.StaticLabels,
+		Encoding:     fConfig.Encoding,
+		Format:       fConfig.Format,
+		TenantId:     fConfig.TenantId,
+		MaxRetries:   5,
+	}
+
+	if config.Labels == nil {
+		config.Labels = []string{"unit", "hostname", "priority"}
+	}
+	if err := validateLokiLabels(config.Labels); err != nil {
+		return nil, err
+	}
+	if config.StaticLabels == nil {
+		config.StaticLabels = map[string]string{
+			"job": "journald-cloudwatch-logs",
+		}
+	}
+
+	switch config.Encoding {
+	case "":
+		config.Encoding = "protobuf"
+	case "protobuf", "json":
+	default:
+		return nil, fmt.Errorf("'%s' is not a supported encoding", config.Encoding)
+	}
+
+	if config.Format == "" {
+		config.Format = defaultFormat
+	}
+	if _, err := GetEncoder(config.Format); err != nil {
+		return nil, err
+	}
+
+	if fConfig.MaxRetries != nil {
+		if *fConfig.MaxRetries < 0 {
+			return nil, fmt.Errorf("max_retries must not be negative")
+		}
+		config.MaxRetries = *fConfig.MaxRetries
+	}
+
+	var err error
+	config.Auth, err = fConfig.httpAuthConfig.resolve()
+	if err != nil {
+		return nil, err
+	}
+	config.TLS, err = fConfig.tlsConfig.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func loadOTLPSinkConfig(fConfig *otlpSinkConfig) (*OTLPSinkConfig, error) {
+	config := &OTLPSinkConfig{
+		Endpoint:    strings.TrimSuffix(fConfig.Endpoint, "/"),
+		Protocol:    fConfig.Protocol,
+		Compression: fConfig.Compression,
+		Headers:     fConfig.Headers,
+		MaxRetries:  5,
+	}
+
+	switch config.Protocol {
+	case "", "http":
+		config.Protocol = "http"
+		if config.Endpoint == "" {
+			config.Endpoint = "http://localhost:4318"
+		}
+	case "grpc":
+		if config.Endpoint == "" {
+			config.Endpoint = "http://localhost:4317"
+		}
+	default:
+		return nil, fmt.Errorf("'%s' is not a supported protocol", config.Protocol)
+	}
+	if !strings.HasPrefix(config.Endpoint, "http://") && !strings.HasPrefix(config.Endpoint, "https://") {
+		return nil, fmt.Errorf("endpoint must be an http:// or https:// URL")
+	}
+
+	switch config.Compression {
+	case "", "none":
+		config.Compression = "none"
+	case "gzip":
+	default:
+		return nil, fmt.Errorf("'%s' is not a supported compression", config.Compression)
+	}
+
+	if fConfig.MaxRetries != nil {
+		if *fConfig.MaxRetries < 0 {
+			return nil, fmt.Errorf("max_retries must not be negative")
+		}
+		config.MaxRetries = *fConfig.MaxRetries
+	}
+
+	var err error
+	config.TLS, err = fConfig.tlsConfig.resolve()
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func loadESSinkConfig(fConfig *esSinkConfig, defaultRegion string) (*ElasticsearchSinkConfig, error) {
+	if fConfig.URL == "" {
+		return nil, fmt.Errorf("url is required")
+	}
+
+	config := &ElasticsearchSinkConfig{
+		URL:             strings.TrimSuffix(fConfig.URL, "/"),
+		Index:           fConfig.Index,
+		IndexDateFormat: "2006.01.02",
+		AWSSigV4:        fConfig.AWSSigV4,
+		AWSRegion:       fConfig.AWSRegion,
+		MaxRetries:      5,
+	}
+
+	if config.Index == "" {
+		config.Index = "journald"
+	}
+	if fConfig.IndexDateFormat != nil {
+		config.IndexDateFormat = *fConfig.IndexDateFormat
+	}
+	if config.AWSRegion == "" {
+		config.AWSRegion = defaultRegion
+	}
+
+	if fConfig.MaxRetries != nil {
+		if *fConfig.MaxRetries < 0 {
+			return nil, fmt.Errorf("max_retries must not be negative")
+		}
+		config.MaxRetries = *fConfig.MaxRetries
+	}
+
+	var err error
+	config.Auth, err = fConfig.httpAuthConfig.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if config.AWSSigV4 && (config.Auth.Username != "" || config.Auth.BearerToken != "") {
+		return nil, fmt.Errorf("aws_sigv4 can't be used with other credentials")
+	}
+	config.TLS, err = fConfig.tlsConfig.resolve()
+	if err != nil {
+		return nil, err
+	}
 
 	return config, nil
 }
 
+// parseByteSize parses sizes like "512", "64KB", "100MB" or "1GB", using
+// binary multiples.
+func parseByteSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		scale  int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	}
+
+	scale := int64(1)
+	num := strings.TrimSpace(strings.ToUpper(s))
+	for _, unit := range units {
+		if strings.HasSuffix(num, unit.suffix) {
+			num = strings.TrimSpace(strings.TrimSuffix(num, unit.suffix))
+			scale = unit.scale
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("'%s' is not a valid size", s)
+	}
+	return n * scale, nil
+}
+
 func (c *Config) NewAWSSession() *awsSession.Session {
+	return c.NewAWSSessionWithCredentials(c.AWSCredentials)
+}
+
+func (c *Config) NewAWSSessionWithCredentials(creds *awsCredentials.Credentials) *awsSession.Session {
 	config := &aws.Config{
-		Credentials: c.AWSCredentials,
+		Credentials: creds,
 		Region:      aws.String(c.AWSRegion),
 		MaxRetries:  aws.Int(3),
+		HTTPClient:  c.AWSHTTPClient,
 	}
 	return awsSession.New(config)
 }
 
-
-/*
- * Expand variables of the form $Foo or ${Foo} in the user provided config
- * from the EC2Metadata Instance Identity Document
- * [ https://docs.aws.amazon.com/sdk-for-go/api/aws/ec2metadata/#EC2InstanceIdentityDocument ]
- * or the environment
- */
-func expandFileConfig(config *fileConfig, metaClient *ec2metadata.EC2Metadata) {
-	vars := make(map[string]string)
-
-	// If we can fetch the InstanceIdentityDocument then iterate over the
-	// struct extracting the string fields and their values into the vars map
-	data, err := metaClient.GetInstanceIdentityDocument()
-	if err == nil {
-		metadata := reflect.ValueOf( data )
-
-		for i := 0; i < metadata.NumField(); i++ {
-			field := metadata.Field(i)
-			ftype := metadata.Type().Field(i)
-			if (field.Type() != reflect.TypeOf("")) {
-				continue
-			}
-			vars[ftype.Name] = fmt.Sprintf("%v", field.Interface())
-		}
-	}
-
-	// Iterate over all the string fields in the fileConfig struct performing
-	// Variable expansion on them, with EC2 Instance Identity fields overriding
-	// the OS environment
-	rconfig := reflect.ValueOf(config)
-	for i := 0; i < rconfig.Elem().NumField(); i++ {
-		field := rconfig.Elem().Field(i)
-		if field.Type() != reflect.TypeOf("") {
-			continue
-		}
-		val := field.Interface().(string)
-		if val != "" {
-			field.SetString(
-				expandBraceVars(
-					val,
-					func(varname string) string {
-						if strings.HasPrefix(varname, "instance.") {
-							if val, exists := vars[strings.TrimPrefix(varname, "instance.")]; exists {
-								return val
-							}
-							// Unknown key => empty string
-							return "" 
-						} else if (strings.HasPrefix(varname, "env.")) {
-							return os.Getenv(strings.TrimPrefix(varname, "env."))
-						} else {
-							// Unknown prefix => empty string
-							return ""
-						}
-					},
-				),
-			)
-		}
-	}
-}
-
-
-// Modified version of os.Expand() that only expands ${name} and not $name
-func expandBraceVars(s string, mapping func(string) string) string {
-	buf := make([]byte, 0, 2*len(s))
-	// ${} is all ASCII, so bytes are fine for this operation.
-	i := 0
-	for j := 0; j < len(s); j++ {
-		if s[j] == '$' && j+3 < len(s) && s[j+1] == '{' {
-			buf = append(buf, s[i:j]...)
-			idx := strings.Index(s[j+2:], "}")
-			if (idx >= 0) {
-				// We have a full ${name} string
-				buf = append(buf, mapping(s[j+2:j+2+idx])...)
-				j += 2+idx
-			} else {
-				// We ran out of string (unclosed ${)
-				return string(buf)
-			}
-			i = j + 1
-		}
-	}
-	return string(buf) + s[i:]
+func (c *Config) NewCloudWatchClient(sess *awsSession.Session) *cloudwatchlogs.CloudWatchLogs {
+	return cloudwatchlogs.New(sess, endpointConfig(c.AWSEndpoints.CloudWatch))
 }
 
+// NewMetadataClient returns a client for the EC2 instance metadata
+// service. Since the service is local when it's available at all, the
+// client gives up sooner than the others.
+func (c *Config) NewMetadataClient() (*ec2metadata.EC2Metadata, error) {
+	httpClient, err := newAWSHTTPClient(c.AWSTLS, c.MetadataTimeout)
+	if err != nil {
+		return nil, err
+	}
 
+	config := endpointConfig(c.AWSEndpoints.EC2Metadata)
+	if config.Endpoint != nil {
+		// The SDK's default endpoint includes the API version.
+		config.Endpoint = aws.String(strings.TrimSuffix(*config.Endpoint, "/") + "/latest")
+	}
+	config.HTTPClient = httpClient
+	config.MaxRetries = aws.Int(1)
+
+	client := ec2metadata.New(awsSession.New(), config)
+	useIMDSv2(client, httpClient, c.MetadataTokenTTL, c.MetadataV1Fallback)
+	return client, nil
+}
+
+func endpointConfig(endpoint string) *aws.Config {
+	config := &aws.Config{}
+	if endpoint != "" {
+		config.Endpoint = aws.String(endpoint)
+	}
+	return config
+}
 
+// newAWSHTTPClient returns an HTTP client for AWS API calls that applies
+// the aws_ca_bundle and aws_insecure_skip_verify settings. It's otherwise
+// like the default client, keeping the proxy settings and the dial,
+// handshake and idle connection timeouts of the default transport.
+func newAWSHTTPClient(tlsConf TLSConfig, timeout time.Duration) (*http.Client, error) {
+	tlsConfig, err := tlsConf.Load()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+	}, nil
+}
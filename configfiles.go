@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl"
+	"github.com/hashicorp/hcl/hcl/ast"
+	hclstrconv "github.com/hashicorp/hcl/hcl/strconv"
+	"github.com/hashicorp/hcl/hcl/token"
+)
+
+// envOverridePrefix is the prefix of environment variables that override
+// config settings, like JOURNALD_CLOUDWATCH_LOGS_LOG_GROUP.
+const envOverridePrefix = "JOURNALD_CLOUDWATCH_LOGS_"
+
+// ReadConfigFiles reads the config from the given file, or from every .hcl
+// file in the given directory in name order, along with any files they
+// include. Each layer is merged over the ones before it, followed by the
+// overrides from the environment and then the given overrides, which are
+// of the form path.to.setting=value.
+//
+// Blocks are merged setting by setting, with later values replacing
+// earlier ones, except that lists are appended to. An empty list clears
+// the list that has been built up so far.
+func ReadConfigFiles(filename string, overrides []string) (*ast.ObjectList, error) {
+	root := &ast.ObjectList{}
+
+	filenames, err := configDirFiles(filename)
+	if err != nil {
+		return nil, err
+	}
+	loaded := map[string]bool{}
+	for _, filename := range filenames {
+		err = readConfigFile(root, filename, loaded)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var envOverrides []string
+	for _, env := range os.Environ() {
+		if !strings.HasPrefix(env, envOverridePrefix) {
+			continue
+		}
+		// LOKI__URL=value overrides loki.url
+		setting := strings.TrimPrefix(env, envOverridePrefix)
+		i := strings.Index(setting, "=")
+		name := strings.Replace(strings.ToLower(setting[:i]), "__", ".", -1)
+		envOverrides = append(envOverrides, name+setting[i:])
+	}
+	sort.Strings(envOverrides)
+
+	for i, setting := range append(envOverrides, overrides...) {
+		item, err := parseConfigOverride(setting)
+		if err != nil {
+			return nil, err
+		}
+		if i < len(envOverrides) {
+			setConfigFilename(item, "environment")
+		} else {
+			setConfigFilename(item, "command line")
+		}
+		mergeConfigItem(root, item)
+	}
+
+	return root, nil
+}
+
+// configDirFiles returns the given filename, or if it's a directory, the
+// .hcl files in it.
+func configDirFiles(filename string) ([]string, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{filename}, nil
+	}
+	filenames, err := filepath.Glob(filepath.Join(filename, "*.hcl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+// readConfigFile merges the given file into root, followed by the files
+// named by its include setting. Each file is only read once.
+func readConfigFile(root *ast.ObjectList, filename string, loaded map[string]bool) error {
+	abs, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	if loaded[abs] {
+		return nil
+	}
+	loaded[abs] = true
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	file, err := hcl.ParseBytes(data)
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+	list, ok := file.Node.(*ast.ObjectList)
+	if !ok {
+		return fmt.Errorf("%s: not a valid config file", filename)
+	}
+	setConfigFilename(list, filename)
+
+	var includes []string
+	for _, item := range list.Items {
+		if configKey(item.Keys[0]) != "include" {
+			mergeConfigItem(root, item)
+			continue
+		}
+
+		var patterns []string
+		err = hcl.DecodeObject(&patterns, item.Val)
+		if err != nil {
+			return fmt.Errorf("%s: include must be a list of file patterns", filename)
+		}
+		for _, pattern := range patterns {
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(filename), pattern)
+			}
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid include %q: %s", filename, pattern, err)
+			}
+			sort.Strings(matches)
+			includes = append(includes, matches...)
+		}
+	}
+
+	for _, include := range includes {
+		err = readConfigFile(root, include, loaded)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseConfigOverride parses a setting of the form path.to.setting=value.
+// The value may be anything that could appear in a config file; anything
+// else is taken to be a string.
+func parseConfigOverride(setting string) (*ast.ObjectItem, error) {
+	i := strings.Index(setting, "=")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid setting %q: must be of the form name=value", setting)
+	}
+	path, value := setting[:i], setting[i+1:]
+
+	var val ast.Node
+	if file, err := hcl.ParseString("value = " + value); err == nil {
+		if list, ok := file.Node.(*ast.ObjectList); ok && len(list.Items) == 1 {
+			val = list.Items[0].Val
+		}
+	}
+	if val == nil {
+		lit, err := newConfigString(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid setting %q: %s", setting, err)
+		}
+		val = lit
+	}
+
+	item := &ast.ObjectItem{Val: val}
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			return nil, fmt.Errorf("invalid setting name %q", path)
+		}
+		item.Keys = append(item.Keys, newConfigKey(key))
+	}
+	return item, nil
+}
+
+// mergeConfigItem merges a single setting or block into the list.
+func mergeConfigItem(list *ast.ObjectList, item *ast.ObjectItem) {
+	item = nestConfigItem(item)
+	key := configKey(item.Keys[0])
+
+	var existing *ast.ObjectItem
+	for _, other := range list.Items {
+		if configKey(other.Keys[0]) == key {
+			existing = other
+			break
+		}
+	}
+	if existing == nil {
+		existing = &ast.ObjectItem{Keys: item.Keys}
+		list.Add(existing)
+	}
+
+	switch val := item.Val.(type) {
+	case *ast.ObjectType:
+		obj, ok := existing.Val.(*ast.ObjectType)
+		if !ok {
+			obj = &ast.ObjectType{List: &ast.ObjectList{}}
+			existing.Val = obj
+		}
+		for _, child := range val.List.Items {
+			mergeConfigItem(obj.List, child)
+		}
+	case *ast.ListType:
+		if prev, ok := existing.Val.(*ast.ListType); ok && len(val.List) > 0 {
+			existing.Val = &ast.ListType{List: append(append([]ast.Node(nil), prev.List...), val.List...)}
+		} else {
+			existing.Val = val
+		}
+	default:
+		existing.Val = val
+	}
+}
+
+// nestConfigItem turns a labelled block like `cloudwatch "name" {...}`
+// into the equivalent nested blocks, `cloudwatch { name {...} }`, so that
+// blocks can be merged however they were written.
+func nestConfigItem(item *ast.ObjectItem) *ast.ObjectItem {
+	if len(item.Keys) == 1 {
+		return item
+	}
+	inner := nestConfigItem(&ast.ObjectItem{
+		Keys: item.Keys[1:],
+		Val:  item.Val,
+	})
+	return &ast.ObjectItem{
+		Keys: item.Keys[:1],
+		Val: &ast.ObjectType{
+			List: &ast.ObjectList{Items: []*ast.ObjectItem{inner}},
+		},
+	}
+}
+
+// setConfigFilename records where the settings in the given part of the
+// config came from, so that errors about them can say so.
+func setConfigFilename(node ast.Node, filename string) {
+	ast.Walk(node, func(n ast.Node) (ast.Node, bool) {
+		switch n := n.(type) {
+		case *ast.ObjectKey:
+			n.Token.Pos.Filename = filename
+		case *ast.LiteralType:
+			n.Token.Pos.Filename = filename
+		}
+		return n, true
+	})
+}
+
+// newConfigString returns a string literal with the given value.
+func newConfigString(value string) (*ast.LiteralType, error) {
+	text := strconv.Quote(value)
+	// HCL strings can't contain a ${ without a matching }.
+	_, err := hclstrconv.Unquote(text)
+	if err != nil {
+		return nil, err
+	}
+	return &ast.LiteralType{
+		Token: token.Token{Type: token.STRING, Text: text},
+	}, nil
+}
+
+func configKey(key *ast.ObjectKey) string {
+	if s, ok := key.Token.Value().(string); ok {
+		return s
+	}
+	return key.Token.Text
+}
+
+func newConfigKey(name string) *ast.ObjectKey {
+	tok := token.Token{Type: token.IDENT, Text: name}
+	for i, c := range name {
+		if !(c == '_' || c == '-' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || i > 0 && '0' <= c && c <= '9') {
+			tok = token.Token{Type: token.STRING, Text: strconv.Quote(name)}
+			break
+		}
+	}
+	return &ast.ObjectKey{Token: tok}
+}
+
+// FormatConfig returns the given config as HCL.
+func FormatConfig(list *ast.ObjectList) []byte {
+	var buf bytes.Buffer
+	formatConfigList(&buf, list, "")
+	return buf.Bytes()
+}
+
+func formatConfigList(buf *bytes.Buffer, list *ast.ObjectList, indent string) {
+	for _, item := range list.Items {
+		buf.WriteString(indent)
+		for _, key := range item.Keys {
+			buf.WriteString(newConfigKey(configKey(key)).Token.Text)
+			buf.WriteString(" ")
+		}
+		if obj, ok := item.Val.(*ast.ObjectType); ok {
+			buf.WriteString("{\n")
+			formatConfigList(buf, obj.List, indent+"    ")
+			buf.WriteString(indent + "}\n")
+			continue
+		}
+		buf.WriteString("= ")
+		formatConfigValue(buf, item.Val, indent)
+		buf.WriteString("\n")
+	}
+}
+
+func formatConfigValue(buf *bytes.Buffer, node ast.Node, indent string) {
+	switch val := node.(type) {
+	case *ast.LiteralType:
+		buf.WriteString(val.Token.Text)
+	case *ast.ListType:
+		buf.WriteString("[")
+		for i, elem := range val.List {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			formatConfigValue(buf, elem, indent)
+		}
+		buf.WriteString("]")
+	case *ast.ObjectType:
+		buf.WriteString("{\n")
+		formatConfigList(buf, val.List, indent+"    ")
+		buf.WriteString(indent + "}")
+	}
+}
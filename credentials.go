@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsCredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	ecsCredentialsHost = "169.254.170.2"
+
+	// credentialsExpiryWindow is how long before temporary credentials
+	// expire that they're refreshed, so that requests in flight don't
+	// fail with expired tokens.
+	credentialsExpiryWindow = 5 * time.Minute
+
+	defaultRoleSessionName = "journald-cloudwatch-logs"
+)
+
+// AssumeRole describes an IAM role to assume with STS.
+type AssumeRole struct {
+	RoleARN     string
+	ExternalID  string
+	SessionName string
+}
+
+type roleConfig struct {
+	RoleARN     string `hcl:"role_arn"`
+	ExternalID  string `hcl:"role_external_id"`
+	SessionName string `hcl:"role_session_name"`
+}
+
+func (c *roleConfig) resolve() (*AssumeRole, error) {
+	if c.RoleARN == "" {
+		if c.ExternalID != "" || c.SessionName != "" {
+			return nil, fmt.Errorf("role_external_id and role_session_name require role_arn")
+		}
+		return nil, nil
+	}
+
+	role := &AssumeRole{
+		RoleARN:     c.RoleARN,
+		ExternalID:  c.ExternalID,
+		SessionName: c.SessionName,
+	}
+	if role.SessionName == "" {
+		role.SessionName = defaultRoleSessionName
+	}
+	return role, nil
+}
+
+// loadCredentials sets up the credentials used for all AWS requests. These
+// are, in order of preference:
+//
+//   - a role assumed with a web identity token, if web_identity_token_file
+//     (or AWS_WEB_IDENTITY_TOKEN_FILE) is set
+//   - the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+//   - the named profile in the shared credentials file
+//   - the ECS task role, if running in an ECS task
+//   - the EC2 instance profile
+//
+// If role_arn is set (other than for a web identity) then those
+// credentials are only used to assume that role.
+func (c *Config) loadCredentials(fConfig *fileConfig, metaClient *ec2metadata.EC2Metadata) error {
+	role, err := fConfig.roleConfig.resolve()
+	if err != nil {
+		return err
+	}
+
+	tokenFile := fConfig.WebIdentityTokenFile
+	if tokenFile == "" && fConfig.RoleARN == "" {
+		// These are set for pods using IAM roles for service
+		// accounts, so they work without any configuration.
+		tokenFile = os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+		if tokenFile != "" {
+			role, err = (&roleConfig{
+				RoleARN:     os.Getenv("AWS_ROLE_ARN"),
+				SessionName: os.Getenv("AWS_ROLE_SESSION_NAME"),
+			}).resolve()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if tokenFile != "" {
+		if role == nil {
+			return fmt.Errorf("web_identity_token_file requires role_arn")
+		}
+		if role.ExternalID != "" {
+			return fmt.Errorf("role_external_id can't be used with web_identity_token_file")
+		}
+		c.AWSCredentials = awsCredentials.NewCredentials(&webIdentityProvider{
+			client:    c.newSTSClient(awsCredentials.AnonymousCredentials),
+			tokenFile: tokenFile,
+			role:      role,
+		})
+		return nil
+	}
+
+	providers := []awsCredentials.Provider{
+		&awsCredentials.EnvProvider{},
+		&awsCredentials.SharedCredentialsProvider{
+			Profile: fConfig.AWSProfile,
+		},
+	}
+	if uri := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); uri != "" {
+		// The SDK's default client is used unless the AWS TLS
+		// settings call for our own.
+		clientConfig := defaults.Config()
+		clientConfig.MergeIn(&aws.Config{HTTPClient: c.AWSHTTPClient})
+		providers = append(providers, endpointcreds.NewProviderClient(
+			*clientConfig,
+			defaults.Handlers(),
+			"http://"+ecsCredentialsHost+uri,
+			func(p *endpointcreds.Provider) {
+				p.ExpiryWindow = credentialsExpiryWindow
+			},
+		))
+	}
+	providers = append(providers, &ec2rolecreds.EC2RoleProvider{
+		Client:       metaClient,
+		ExpiryWindow: credentialsExpiryWindow,
+	})
+	c.AWSCredentials = awsCredentials.NewChainCredentials(providers)
+
+	if role != nil {
+		c.AWSCredentials = c.assumeRole(c.AWSCredentials, role)
+	}
+	return nil
+}
+
+// assumeRole returns credentials for the given role, which are obtained
+// using the source credentials.
+func (c *Config) assumeRole(source *awsCredentials.Credentials, role *AssumeRole) *awsCredentials.Credentials {
+	return stscreds.NewCredentialsWithClient(
+		c.newSTSClient(source),
+		role.RoleARN,
+		func(p *stscreds.AssumeRoleProvider) {
+			p.RoleSessionName = role.SessionName
+			if role.ExternalID != "" {
+				p.ExternalID = aws.String(role.ExternalID)
+			}
+			p.ExpiryWindow = credentialsExpiryWindow
+		},
+	)
+}
+
+func (c *Config) newSTSClient(creds *awsCredentials.Credentials) *sts.STS {
+	return sts.New(c.NewAWSSessionWithCredentials(creds), endpointConfig(c.AWSEndpoints.STS))
+}
+
+// webIdentityProvider assumes a role using an OpenID Connect token read
+// from a file, such as a Kubernetes service account token. The file is
+// read again each time the credentials are refreshed, since the token it
+// contains is rotated too.
+type webIdentityProvider struct {
+	awsCredentials.Expiry
+
+	client    *sts.STS
+	tokenFile string
+	role      *AssumeRole
+}
+
+func (p *webIdentityProvider) Retrieve() (awsCredentials.Value, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return awsCredentials.Value{}, fmt.Errorf("unable to read web identity token: %s", err)
+	}
+
+	resp, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.role.RoleARN),
+		RoleSessionName:  aws.String(p.role.SessionName),
+		WebIdentityToken: aws.String(strings.TrimSpace(string(token))),
+	})
+	if err != nil {
+		return awsCredentials.Value{}, err
+	}
+
+	p.SetExpiration(*resp.Credentials.Expiration, credentialsExpiryWindow)
+	return awsCredentials.Value{
+		AccessKeyID:     *resp.Credentials.AccessKeyId,
+		SecretAccessKey: *resp.Credentials.SecretAccessKey,
+		SessionToken:    *resp.Credentials.SessionToken,
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
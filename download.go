@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// DownloadOptions selects the stream to download, and optionally the time
+// span of its events to download.
+type DownloadOptions struct {
+	Since, Until  time.Time
+	LogGroupName  string
+	LogStreamName string
+}
+
+// exportField is a field of an entry in Journal Export Format.
+type exportField struct {
+	name, value string
+}
+
+// Download writes the events in a Cloudwatch Logs stream to w in systemd's
+// Journal Export Format, which systemd-journal-remote can import. Events
+// in the json or compact_json format are decoded back into the journal
+// fields they came from, while any others become entries with only the
+// event as their message.
+//
+// The instance metadata is only consulted to identify the host, and so
+// name its stream, if queryAWS is set, so that other streams can be
+// downloaded from anywhere.
+//
+// See https://systemd.io/JOURNAL_EXPORT_FORMATS/
+func Download(w io.Writer, filename string, overrides []string, queryAWS bool, opts DownloadOptions) error {
+	var config *Config
+	var err error
+	if queryAWS {
+		config, err = LoadConfig(filename, overrides)
+	} else {
+		config, err = LoadConfigForAWS(filename, overrides)
+	}
+	if err != nil {
+		return fmt.Errorf("error reading config: %s", err)
+	}
+	if config.AWSRegion == "" {
+		return fmt.Errorf("download requires aws_region when the region can't be found without the instance metadata; add -set aws_region=<region>")
+	}
+
+	if opts.LogGroupName == "" {
+		if config.LogGroupName == "" {
+			return fmt.Errorf("download requires -log-group when log_group isn't set")
+		}
+		opts.LogGroupName = config.LogGroupName
+	}
+	if opts.LogStreamName == "" {
+		if config.IdentityOffline {
+			return fmt.Errorf("download requires -stream, or -aws to identify the host and use its log_stream")
+		}
+		opts.LogStreamName = config.LogStreamName
+	}
+
+	out := bufio.NewWriter(w)
+	client := config.NewCloudWatchClient(config.NewAWSSession())
+	var count, decoded int
+	err = getLogEvents(client, opts.LogGroupName, opts.LogStreamName, opts.Since, opts.Until, func(event *cloudwatchlogs.OutputLogEvent) error {
+		fields, ok := exportEntry(event)
+		count++
+		if ok {
+			decoded++
+		}
+		return writeExportEntry(out, fields)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to get events from %s/%s: %s", opts.LogGroupName, opts.LogStreamName, err)
+	}
+	err = out.Flush()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("downloaded %d events from %s/%s, %d of them with their journal fields", count, opts.LogGroupName, opts.LogStreamName, decoded)
+	return nil
+}
+
+// exportEntry returns the journal fields of an event, and whether they
+// were decoded from a record rather than just the event's message.
+func exportEntry(event *cloudwatchlogs.OutputLogEvent) ([]exportField, bool) {
+	message := aws.StringValue(event.Message)
+	timestamp := aws.Int64Value(event.Timestamp) * 1000
+
+	var record Record
+	var raw map[string]json.RawMessage
+	ok := strings.HasPrefix(message, "{") &&
+		json.Unmarshal([]byte(message), &raw) == nil &&
+		raw["message"] != nil &&
+		json.Unmarshal([]byte(message), &record) == nil
+	if !ok {
+		return []exportField{
+			{"__REALTIME_TIMESTAMP", strconv.FormatInt(timestamp, 10)},
+			{"MESSAGE", message},
+		}, false
+	}
+
+	var fields []exportField
+	if record.JournalCursor != "" {
+		fields = append(fields, exportField{"__CURSOR", record.JournalCursor})
+	}
+	fields = append(fields, exportField{"__REALTIME_TIMESTAMP", strconv.FormatInt(timestamp, 10)})
+	record.VisitJournalFields(func(name string, value interface{}) {
+		fields = append(fields, exportField{name, fmt.Sprint(value)})
+	})
+	if record.Priority == EMERGENCY {
+		// Zero values aren't visited, but the priority is always
+		// given.
+		fields = append(fields, exportField{"PRIORITY", "0"})
+	}
+	// Nor are the ids of root, which the event gives like any other.
+	if record.UID == 0 && raw["uid"] != nil {
+		fields = append(fields, exportField{"_UID", "0"})
+	}
+	if record.GID == 0 && raw["gid"] != nil {
+		fields = append(fields, exportField{"_GID", "0"})
+	}
+	if record.InstanceId != "" {
+		fields = append(fields, exportField{"INSTANCE_ID", record.InstanceId})
+	}
+	return fields, true
+}
+
+// writeExportEntry writes an entry in Journal Export Format. Values that
+// aren't printable text on one line are written in the binary form, with
+// their length.
+func writeExportEntry(w *bufio.Writer, fields []exportField) error {
+	for _, field := range fields {
+		w.WriteString(field.name)
+		if isExportText(field.value) {
+			w.WriteByte('=')
+			w.WriteString(field.value)
+		} else {
+			w.WriteByte('\n')
+			binary.Write(w, binary.LittleEndian, uint64(len(field.value)))
+			w.WriteString(field.value)
+		}
+		w.WriteByte('\n')
+	}
+	return w.WriteByte('\n')
+}
+
+func isExportText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, c := range s {
+		if c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+func TestExportEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		record  *Record
+		want    map[string]string
+		missing []string
+	}{
+		{
+			name: "root",
+			record: &Record{
+				Message:  "session opened",
+				Priority: EMERGENCY,
+				UID:      0,
+				GID:      0,
+				PID:      42,
+			},
+			want: map[string]string{"MESSAGE": "session opened", "PRIORITY": "0", "_UID": "0", "_GID": "0", "_PID": "42"},
+		},
+		{
+			name: "another user",
+			record: &Record{
+				Message:  "hello",
+				Priority: INFO,
+				UID:      1000,
+				GID:      100,
+			},
+			want: map[string]string{"PRIORITY": "6", "_UID": "1000", "_GID": "100"},
+		},
+		{
+			name:    "ids not given",
+			message: `{"message": "hello", "priority": "INFO"}`,
+			want:    map[string]string{"MESSAGE": "hello"},
+			missing: []string{"_UID", "_GID"},
+		},
+		{
+			name:    "text",
+			message: "just text",
+			want:    map[string]string{"MESSAGE": "just text"},
+			missing: []string{"PRIORITY", "_UID"},
+		},
+	}
+
+	for _, test := range tests {
+		message := test.message
+		if test.record != nil {
+			encoded, err := json.Marshal(test.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message = string(encoded)
+		}
+		fields, _ := exportEntry(&cloudwatchlogs.OutputLogEvent{
+			Message:   aws.String(message),
+			Timestamp: aws.Int64(1700000000000),
+		})
+
+		got := map[string]string{}
+		for _, field := range fields {
+			if _, ok := got[field.name]; ok {
+				t.Errorf("%s: %s is given twice", test.name, field.name)
+			}
+			got[field.name] = field.value
+		}
+		if got["__REALTIME_TIMESTAMP"] != "1700000000000000" {
+			t.Errorf("%s: timestamp is %q", test.name, got["__REALTIME_TIMESTAMP"])
+		}
+		for name, value := range test.want {
+			if got[name] != value {
+				t.Errorf("%s: %s is %q, want %q", test.name, name, got[name], value)
+			}
+		}
+		for _, name := range test.missing {
+			if _, ok := got[name]; ok {
+				t.Errorf("%s: unexpected %s", test.name, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	awsCredentials "github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// ElasticsearchSink indexes records into Elasticsearch or OpenSearch
+// using the bulk API.
+type ElasticsearchSink struct {
+	config *ElasticsearchSinkConfig
+	poster *httpPoster
+}
+
+type esBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int             `json:"status"`
+		Error  json.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+func NewElasticsearchSink(config *ElasticsearchSinkConfig, creds *awsCredentials.Credentials) (*ElasticsearchSink, error) {
+	poster, err := newHTTPPoster(config.TLS, config.Auth, config.MaxRetries)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.AWSSigV4 {
+		signer := v4.NewSigner(creds)
+		poster.sign = func(req *http.Request, body []byte) error {
+			_, err := signer.Sign(req, bytes.NewReader(body), "es", config.AWSRegion, time.Now())
+			return err
+		}
+	}
+
+	return &ElasticsearchSink{
+		config: config,
+		poster: poster,
+	}, nil
+}
+
+func (s *ElasticsearchSink) Name() string {
+	return "elasticsearch " + s.config.URL
+}
+
+// WriteBatch indexes the given records. If only some of the items in a
+// bulk request fail then only those are sent again. Items that fail in a
+// way that retrying won't fix, such as a mapping conflict, are logged and
+// dropped so that they can't hold up the rest of the journal.
+func (s *ElasticsearchSink) WriteBatch(records []Record) error {
+	pending := make([]*Record, len(records))
+	for i := range records {
+		pending[i] = &records[i]
+	}
+
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		failed, err := s.bulk(pending)
+		if err != nil {
+			return err
+		}
+		if len(failed) == 0 {
+			return nil
+		}
+		if attempt >= s.config.MaxRetries {
+			return fmt.Errorf("%d items still failing after %d retries", len(failed), attempt)
+		}
+
+		pending = failed
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > httpMaxBackoff {
+			backoff = httpMaxBackoff
+		}
+	}
+}
+
+func (s *ElasticsearchSink) Close() error {
+	return nil
+}
+
+// bulk sends a single bulk request, returning the records whose items
+// failed with a retryable status.
+func (s *ElasticsearchSink) bulk(records []*Record) ([]*Record, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, record := range records {
+		action := map[string]string{
+			"_index": s.indexName(record),
+		}
+		if record.Cursor != "" {
+			// The cursor uniquely identifies the journal entry,
+			// so indexing it again just replaces the document.
+			action["_id"] = record.Cursor
+		}
+		err := enc.Encode(map[string]interface{}{"index": action})
+		if err != nil {
+			return nil, err
+		}
+
+		doc := struct {
+			Timestamp string `json:"@timestamp"`
+			*Record
+		}{
+			Timestamp: record.Time().UTC().Format(time.RFC3339Nano),
+			Record:    record,
+		}
+		err = enc.Encode(doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	respBody, err := s.poster.post(s.config.URL+"/_bulk", "application/x-ndjson", body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	var resp esBulkResponse
+	err = json.Unmarshal(respBody, &resp)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bulk response: %s", err)
+	}
+	if !resp.Errors {
+		return nil, nil
+	}
+	if len(resp.Items) != len(records) {
+		return nil, fmt.Errorf("bulk response has %d items for %d documents", len(resp.Items), len(records))
+	}
+
+	var failed []*Record
+	for i, item := range resp.Items {
+		for _, result := range item {
+			if result.Status >= 200 && result.Status <= 299 {
+				continue
+			}
+			if result.Status == http.StatusTooManyRequests || result.Status >= 500 {
+				failed = append(failed, records[i])
+				continue
+			}
+			log.Printf("elasticsearch rejected document %q: %s", records[i].Cursor, result.Error)
+		}
+	}
+	return failed, nil
+}
+
+func (s *ElasticsearchSink) indexName(record *Record) string {
+	if s.config.IndexDateFormat == "" {
+		return s.config.Index
+	}
+	return s.config.Index + "-" + record.Time().UTC().Format(s.config.IndexDateFormat)
+}
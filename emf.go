@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// EMFOutputConfig describes where and how often metrics are published in
+// Embedded Metric Format.
+type EMFOutputConfig struct {
+	Interval      time.Duration
+	Namespace     string
+	LogGroupName  string
+	LogStreamName string
+}
+
+type emfOutputConfig struct {
+	Interval      string `hcl:"interval"`
+	Namespace     string `hcl:"namespace"`
+	LogGroupName  string `hcl:"log_group"`
+	LogStreamName string `hcl:"log_stream"`
+}
+
+// resolve returns the output settings, defaulting to a stream alongside
+// the main one, named with the given suffix.
+func (c emfOutputConfig) resolve(logGroupName, logStreamName, suffix string) (*EMFOutputConfig, error) {
+	config := &EMFOutputConfig{
+		Interval:      time.Minute,
+		Namespace:     c.Namespace,
+		LogGroupName:  c.LogGroupName,
+		LogStreamName: c.LogStreamName,
+	}
+
+	if c.Interval != "" {
+		interval, err := time.ParseDuration(c.Interval)
+		if err != nil || interval < time.Second {
+			return nil, fmt.Errorf("interval must be a duration of at least 1s")
+		}
+		config.Interval = interval
+	}
+	if config.Namespace == "" {
+		config.Namespace = "JournaldCloudwatchLogs"
+	}
+	if config.LogGroupName == "" {
+		if logGroupName == "" {
+			return nil, fmt.Errorf("log_group is required when the top-level log_group isn't set")
+		}
+		config.LogGroupName = logGroupName
+	}
+	if config.LogStreamName == "" {
+		// A stream of its own means the metrics can't upset the
+		// sequence tokens of the main stream, or of the other
+		// metrics.
+		config.LogStreamName = logStreamName + suffix
+	}
+	return config, nil
+}
+
+// NewEMFWriter returns a writer for publishing metrics to the given
+// output. The events it's given must be Embedded Metric Format documents
+// in their Message.
+func (c *Config) NewEMFWriter(output *EMFOutputConfig) (*Writer, error) {
+	return NewWriter(
+		c.NewCloudWatchClient(c.NewAWSSession()),
+		output.LogGroupName,
+		output.LogStreamName,
+		"",
+		"message",
+		c.UseSeqTokens,
+	)
+}
+
+// EMFMetric is one metric in an Embedded Metric Format event. Value is
+// either a number or a slice of numbers.
+type EMFMetric struct {
+	Name  string
+	Unit  string
+	Value interface{}
+}
+
+// EncodeEMF returns an event in CloudWatch's Embedded Metric Format, from
+// which CloudWatch Logs extracts the given metrics, with all of the given
+// dimensions, in the namespace.
+//
+// See https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch_Embedded_Metric_Format_Specification.html
+func EncodeEMF(namespace string, dimensions map[string]string, metrics []EMFMetric, timestamp time.Time) ([]byte, error) {
+	type metricDirective struct {
+		Name string `json:"Name"`
+		Unit string `json:"Unit,omitempty"`
+	}
+	type metricDirectives struct {
+		Namespace  string            `json:"Namespace"`
+		Dimensions [][]string        `json:"Dimensions"`
+		Metrics    []metricDirective `json:"Metrics"`
+	}
+	type metadata struct {
+		Timestamp         int64              `json:"Timestamp"`
+		CloudWatchMetrics []metricDirectives `json:"CloudWatchMetrics"`
+	}
+
+	names := []string{}
+	for name := range dimensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	directives := metricDirectives{
+		Namespace:  namespace,
+		Dimensions: [][]string{names},
+	}
+	event := map[string]interface{}{}
+	for name, value := range dimensions {
+		event[name] = value
+	}
+	for _, metric := range metrics {
+		directives.Metrics = append(directives.Metrics, metricDirective{metric.Name, metric.Unit})
+		event[metric.Name] = metric.Value
+	}
+	event["_aws"] = metadata{
+		Timestamp:         timestamp.UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []metricDirectives{directives},
+	}
+
+	return json.Marshal(event)
+}
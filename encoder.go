@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Encoder renders a single record as the body of one output event.
+//
+// Every output uses the same encoders, so that the events written to a
+// local file are byte-for-byte the events that would have been sent to
+// Cloudwatch.
+type Encoder func(record *Record) ([]byte, error)
+
+var encoders = map[string]Encoder{
+	"json":         encodeJSON,
+	"compact_json": encodeCompactJSON,
+	"message":      encodeMessage,
+}
+
+// GetEncoder returns the encoder registered under the given format name.
+func GetEncoder(format string) (Encoder, error) {
+	encoder, ok := encoders[format]
+	if !ok {
+		return nil, fmt.Errorf("'%s' is not a supported format", format)
+	}
+	return encoder, nil
+}
+
+func encodeJSON(record *Record) ([]byte, error) {
+	return json.MarshalIndent(record, "", "  ")
+}
+
+func encodeCompactJSON(record *Record) ([]byte, error) {
+	return json.Marshal(record)
+}
+
+// encodeMessage produces only the text of the message.
+func encodeMessage(record *Record) ([]byte, error) {
+	return []byte(record.Message), nil
+}
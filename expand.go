@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/token"
+)
+
+const bootIdFile = "/proc/sys/kernel/random/boot_id"
+
+// configExpander expands variables of the form ${prefix.name} in the user
+// provided config. The supported prefixes are:
+//
+//   - instance: the host identity (see HostIdentity)
+//   - env: the environment
+//   - host: facts about the host itself: hostname, machine_id and boot_id
+//   - tag: the EC2 instance's tags, if tags are enabled in its metadata
+//
+// ${name:-default} expands to default if name is unset or empty, and
+// ${name:?message} is an error in that case. Otherwise unset and empty
+// variables expand to the empty string, unless strict is set, in which case
+// they're errors.
+type configExpander struct {
+	identity   *HostIdentity
+	metaClient *ec2metadata.EC2Metadata
+	strict     bool
+
+	tags map[string]cachedTag
+}
+
+type cachedTag struct {
+	value string
+	ok    bool
+}
+
+func newConfigExpander(identity *HostIdentity, metaClient *ec2metadata.EC2Metadata, strict bool) *configExpander {
+	return &configExpander{
+		identity:   identity,
+		metaClient: metaClient,
+		strict:     strict,
+		tags:       map[string]cachedTag{},
+	}
+}
+
+// expandConfigTree expands the variables in every string in the config,
+// including those in blocks, lists and maps.
+func expandConfigTree(root *ast.ObjectList, expander *configExpander) error {
+	for _, item := range root.Items {
+		name := configKey(item.Keys[0])
+		if name == "host_identity" {
+			// The host has already been identified by now, so
+			// expanding these would have no effect.
+			continue
+		}
+		err := expander.expandNode(item.Val, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *configExpander) expandNode(node ast.Node, path string) error {
+	switch n := node.(type) {
+	case *ast.LiteralType:
+		if n.Token.Type != token.STRING && n.Token.Type != token.HEREDOC {
+			return nil
+		}
+		s, ok := n.Token.Value().(string)
+		if !ok {
+			return nil
+		}
+		expanded, err := e.expandString(s)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		if expanded != s {
+			lit, err := newConfigString(expanded)
+			if err != nil {
+				return fmt.Errorf("%s: invalid expanded value %q: %s", path, expanded, err)
+			}
+			lit.Token.Pos = n.Token.Pos
+			n.Token = lit.Token
+		}
+
+	case *ast.ListType:
+		for i, elem := range n.List {
+			err := e.expandNode(elem, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+
+	case *ast.ObjectType:
+		for _, item := range n.List.Items {
+			err := e.expandNode(item.Val, joinConfigPath(path, configKey(item.Keys[0])))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func joinConfigPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func (e *configExpander) expandString(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	return expandBraceVars(s, e.expand)
+}
+
+// expand returns the value of a single ${...} reference.
+func (e *configExpander) expand(ref string) (string, error) {
+	name, op, arg := ref, "", ""
+	for _, o := range []string{":-", ":?"} {
+		if i := strings.Index(ref, o); i >= 0 && (op == "" || i < len(name)) {
+			name, op, arg = ref[:i], o, ref[i+len(o):]
+		}
+	}
+
+	value, ok := e.lookup(name)
+	if value != "" {
+		return value, nil
+	}
+
+	switch op {
+	case ":-":
+		return arg, nil
+	case ":?":
+		if arg == "" {
+			arg = "not set"
+		}
+		return "", fmt.Errorf("${%s}: %s", name, arg)
+	}
+
+	if e.strict {
+		if !ok {
+			return "", fmt.Errorf("${%s} is not set", name)
+		}
+		return "", fmt.Errorf("${%s} is empty", name)
+	}
+	return "", nil
+}
+
+// lookup returns the value of the named variable, and whether it exists.
+func (e *configExpander) lookup(name string) (string, bool) {
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return "", false
+	}
+	prefix, key := name[:i], name[i+1:]
+
+	switch prefix {
+	case "instance":
+		value, ok := e.identity.Vars[key]
+		return value, ok
+	case "env":
+		return os.LookupEnv(key)
+	case "host":
+		return lookupHostFact(key)
+	case "tag":
+		return e.lookupTag(key)
+	}
+	return "", false
+}
+
+func lookupHostFact(key string) (string, bool) {
+	var filename string
+	switch key {
+	case "hostname":
+		hostname, err := os.Hostname()
+		return hostname, err == nil
+	case "machine_id":
+		filename = machineIdFile
+	case "boot_id":
+		filename = bootIdFile
+	default:
+		return "", false
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(data)), true
+}
+
+// lookupTag returns the value of an EC2 instance tag. These are only
+// available from the metadata service if the instance allows it.
+func (e *configExpander) lookupTag(key string) (string, bool) {
+	tag, cached := e.tags[key]
+	if !cached && e.metaClient != nil {
+		value, err := e.metaClient.GetMetadata("tags/instance/" + key)
+		tag = cachedTag{value, err == nil}
+		e.tags[key] = tag
+	}
+	return tag.value, tag.ok
+}
+
+// Modified version of os.Expand() that only expands ${name} and not $name
+func expandBraceVars(s string, mapping func(string) (string, error)) (string, error) {
+	buf := make([]byte, 0, 2*len(s))
+	// ${} is all ASCII, so bytes are fine for this operation.
+	i := 0
+	for j := 0; j < len(s); j++ {
+		if s[j] == '$' && j+3 < len(s) && s[j+1] == '{' {
+			buf = append(buf, s[i:j]...)
+			idx := strings.Index(s[j+2:], "}")
+			if idx >= 0 {
+				// We have a full ${name} string
+				value, err := mapping(s[j+2 : j+2+idx])
+				if err != nil {
+					return "", err
+				}
+				buf = append(buf, value...)
+				j += 2 + idx
+			} else {
+				return "", fmt.Errorf("unclosed ${ in %q", s)
+			}
+			i = j + 1
+		}
+	}
+	return string(buf) + s[i:], nil
+}
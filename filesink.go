@@ -0,0 +1,206 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// FileSink writes encoded events to a local file, one per line, rotating
+// the file when it grows too large or too old.
+type FileSink struct {
+	config *FileSinkConfig
+	encode Encoder
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewFileSink(config *FileSinkConfig) (*FileSink, error) {
+	encode, err := GetEncoder(config.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileSink{
+		config: config,
+		encode: encode,
+	}
+	err = s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) Name() string {
+	return "file " + s.config.Path
+}
+
+func (s *FileSink) WriteBatch(records []Record) error {
+	for i := range records {
+		data, err := s.encode(&records[i])
+		if err != nil {
+			return err
+		}
+		data = append(data, '\n')
+
+		if s.needsRotation(int64(len(data))) {
+			err = s.rotate()
+			if err != nil {
+				return fmt.Errorf("failed to rotate: %s", err)
+			}
+		}
+
+		n, err := s.file.Write(data)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The caller commits the journal position once we return, so the
+	// batch must be on disk by then.
+	return s.file.Sync()
+}
+
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
+
+func (s *FileSink) open() error {
+	f, err := os.OpenFile(s.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	s.opened = time.Now()
+	return nil
+}
+
+func (s *FileSink) needsRotation(next int64) bool {
+	if s.size == 0 {
+		// Never rotate an empty file, even if a single event is
+		// larger than the limit.
+		return false
+	}
+	if s.config.MaxSize > 0 && s.size+next > s.config.MaxSize {
+		return true
+	}
+	if s.config.RotateInterval > 0 && time.Since(s.opened) >= s.config.RotateInterval {
+		return true
+	}
+	return false
+}
+
+func (s *FileSink) rotate() error {
+	err := s.file.Sync()
+	if err != nil {
+		return err
+	}
+	err = s.file.Close()
+	if err != nil {
+		return err
+	}
+
+	rotatedName := s.config.Path + "." + time.Now().UTC().Format(rotatedTimeFormat)
+	err = os.Rename(s.config.Path, rotatedName)
+	if err != nil {
+		return err
+	}
+
+	err = s.open()
+	if err != nil {
+		return err
+	}
+
+	if s.config.Compress {
+		err = gzipFile(rotatedName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.prune()
+}
+
+// prune removes the oldest rotated files until at most MaxFiles remain.
+func (s *FileSink) prune() error {
+	if s.config.MaxFiles <= 0 {
+		return nil
+	}
+
+	matches, err := filepath.Glob(s.config.Path + ".*")
+	if err != nil {
+		return err
+	}
+
+	var rotated []string
+	for _, name := range matches {
+		suffix := strings.TrimSuffix(strings.TrimPrefix(name, s.config.Path+"."), ".gz")
+		if _, err := time.Parse(rotatedTimeFormat, suffix); err != nil {
+			// Not one of ours.
+			continue
+		}
+		rotated = append(rotated, name)
+	}
+	if len(rotated) <= s.config.MaxFiles {
+		return nil
+	}
+
+	// The timestamp suffix sorts lexically in time order.
+	sort.Strings(rotated)
+	for _, name := range rotated[:len(rotated)-s.config.MaxFiles] {
+		err = os.Remove(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gzipFile replaces the named file with a gzip-compressed copy whose name
+// has a .gz suffix.
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return os.Remove(name)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	httpRequestTimeout = 30 * time.Second
+	httpMaxBackoff     = 30 * time.Second
+	httpMaxErrorBody   = 512
+)
+
+// HTTPAuth holds the credentials the HTTP-based outputs present to their
+// servers. At most one of basic auth and a bearer token may be used.
+type HTTPAuth struct {
+	Username    string
+	Password    string
+	BearerToken string
+}
+
+type httpAuthConfig struct {
+	Username    string `hcl:"username"`
+	Password    string `hcl:"password"`
+	BearerToken string `hcl:"bearer_token"`
+}
+
+func (c httpAuthConfig) resolve() (HTTPAuth, error) {
+	if c.BearerToken != "" && (c.Username != "" || c.Password != "") {
+		return HTTPAuth{}, fmt.Errorf("bearer_token can't be used with username and password")
+	}
+	if c.Password != "" && c.Username == "" {
+		return HTTPAuth{}, fmt.Errorf("password requires username")
+	}
+	return HTTPAuth(c), nil
+}
+
+func (a HTTPAuth) apply(req *http.Request) {
+	if a.Username != "" {
+		req.SetBasicAuth(a.Username, a.Password)
+	}
+	if a.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+a.BearerToken)
+	}
+}
+
+// HTTPStatusError is returned for a response with an unsuccessful status.
+type HTTPStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPStatusError) Error() string {
+	return fmt.Sprintf("server returned %d: %s", e.StatusCode, e.Body)
+}
+
+// retryable returns true for the statuses that mean the same request
+// might succeed if we try again later.
+func (e *HTTPStatusError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// httpPoster sends request bodies to an HTTP endpoint, retrying with an
+// increasing delay on connection errors and on statuses that indicate a
+// temporary problem on the server.
+type httpPoster struct {
+	client     *http.Client
+	auth       HTTPAuth
+	headers    map[string]string
+	maxRetries int
+
+	// sign, if set, is called on each request just before it's sent.
+	sign func(req *http.Request, body []byte) error
+}
+
+func newHTTPPoster(tlsConf TLSConfig, auth HTTPAuth, maxRetries int) (*httpPoster, error) {
+	tlsConfig, err := tlsConf.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+	}
+
+	return &httpPoster{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   httpRequestTimeout,
+		},
+		auth:       auth,
+		headers:    map[string]string{},
+		maxRetries: maxRetries,
+	}, nil
+}
+
+// post sends the given body and returns the body of the successful
+// response.
+func (p *httpPoster) post(url, contentType string, body []byte) ([]byte, error) {
+	var respBody []byte
+	err := withRetries(p.maxRetries, func() error {
+		var err error
+		respBody, err = p.postOnce(url, contentType, body)
+		return err
+	})
+	return respBody, err
+}
+
+// withRetries calls f until it succeeds or has been retried maxRetries
+// times, waiting longer after each failure. Errors with a retryable
+// method that returns false are returned immediately.
+func withRetries(maxRetries int, f func() error) error {
+	var err error
+	backoff := time.Second
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+			if backoff > httpMaxBackoff {
+				backoff = httpMaxBackoff
+			}
+		}
+
+		err = f()
+		if err == nil {
+			return nil
+		}
+		if r, ok := err.(interface {
+			retryable() bool
+		}); ok && !r.retryable() {
+			return err
+		}
+	}
+	return err
+}
+
+func (p *httpPoster) postOnce(url, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range p.headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", contentType)
+	p.auth.apply(req)
+
+	if p.sign != nil {
+		err = p.sign(req, body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := string(respBody)
+		if len(msg) > httpMaxErrorBody {
+			msg = msg[:httpMaxErrorBody]
+		}
+		return nil, &HTTPStatusError{
+			StatusCode: resp.StatusCode,
+			Body:       msg,
+		}
+	}
+
+	return respBody, nil
+}
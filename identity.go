@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+)
+
+const machineIdFile = "/etc/machine-id"
+
+var defaultIdentityProviders = []string{"static", "ec2", "machine_id", "hostname"}
+
+// HostIdentity describes the host we're running on: the instance id that
+// records are tagged with and that names the default log stream, and the
+// values available to ${instance.*} expansions in the config.
+type HostIdentity struct {
+	// Provider is the name of the provider that identified the host.
+	Provider string
+
+	InstanceId string
+
+	// Region is the AWS region the host is in, if the provider knows it.
+	Region string
+
+	Vars map[string]string
+}
+
+// IdentityProvider identifies the host in one particular way. It returns
+// an error if that way isn't available, e.g. because the host isn't an
+// EC2 instance.
+type IdentityProvider interface {
+	Name() string
+	Identity() (*HostIdentity, error)
+}
+
+type HostIdentityConfig struct {
+	Providers       []string
+	InstanceId      string
+	Region          string
+	Attributes      map[string]string
+	MetadataTimeout time.Duration
+
+	// EC2InstanceId is the legacy ec2_instance_id setting. Unlike
+	// InstanceId it doesn't identify the host by itself, but replaces
+	// the instance id found by whichever provider does, so that the
+	// rest of the EC2 identity document is still used.
+	EC2InstanceId string
+}
+
+type hostIdentityConfig struct {
+	Providers       []string          `hcl:"providers"`
+	InstanceId      string            `hcl:"instance_id"`
+	Region          string            `hcl:"region"`
+	Attributes      map[string]string `hcl:"attributes"`
+	MetadataTimeout string            `hcl:"metadata_timeout"`
+}
+
+// newIdentityProviders returns the providers named by the config, in
+// order.
+func newIdentityProviders(config *HostIdentityConfig, metaClient *ec2metadata.EC2Metadata) ([]IdentityProvider, error) {
+	var providers []IdentityProvider
+	for _, name := range config.Providers {
+		switch name {
+		case "static":
+			providers = append(providers, &staticIdentityProvider{config})
+		case "ec2":
+			providers = append(providers, &ec2IdentityProvider{metaClient})
+		case "machine_id":
+			providers = append(providers, &machineIdIdentityProvider{machineIdFile})
+		case "hostname":
+			providers = append(providers, &hostnameIdentityProvider{})
+		default:
+			return nil, fmt.Errorf("'%s' is not a supported identity provider", name)
+		}
+	}
+	return providers, nil
+}
+
+// DetectHostIdentity returns the identity given by the first of the
+// providers that can identify the host.
+func DetectHostIdentity(providers []IdentityProvider) (*HostIdentity, error) {
+	var errs []string
+	for _, provider := range providers {
+		identity, err := provider.Identity()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", provider.Name(), err))
+			continue
+		}
+
+		identity.Provider = provider.Name()
+		if identity.Vars == nil {
+			identity.Vars = map[string]string{}
+		}
+		if _, ok := identity.Vars["InstanceID"]; !ok {
+			identity.Vars["InstanceID"] = identity.InstanceId
+		}
+		if _, ok := identity.Vars["Region"]; !ok && identity.Region != "" {
+			identity.Vars["Region"] = identity.Region
+		}
+		return identity, nil
+	}
+	return nil, fmt.Errorf("unable to identify host (%s)", strings.Join(errs, "; "))
+}
+
+// overrideInstanceId replaces the instance id of a detected identity,
+// keeping the rest of what the provider found.
+func (identity *HostIdentity) overrideInstanceId(instanceId string) {
+	identity.InstanceId = instanceId
+	identity.Vars["InstanceID"] = instanceId
+}
+
+// staticIdentityProvider uses the instance id given in the config, so it
+// only identifies the host if one was given.
+type staticIdentityProvider struct {
+	config *HostIdentityConfig
+}
+
+func (p *staticIdentityProvider) Name() string {
+	return "static"
+}
+
+func (p *staticIdentityProvider) Identity() (*HostIdentity, error) {
+	if p.config.InstanceId == "" {
+		return nil, fmt.Errorf("instance_id is not set")
+	}
+
+	vars := map[string]string{}
+	for k, v := range p.config.Attributes {
+		vars[k] = v
+	}
+	return &HostIdentity{
+		InstanceId: p.config.InstanceId,
+		Region:     p.config.Region,
+		Vars:       vars,
+	}, nil
+}
+
+// ec2IdentityProvider uses the EC2 instance identity document, whose
+// string fields are all available for expansion under their Go names,
+// like ${instance.AvailabilityZone}.
+type ec2IdentityProvider struct {
+	client *ec2metadata.EC2Metadata
+}
+
+func (p *ec2IdentityProvider) Name() string {
+	return "ec2"
+}
+
+func (p *ec2IdentityProvider) Identity() (*HostIdentity, error) {
+	if p.client == nil {
+		return nil, fmt.Errorf("instance metadata not consulted")
+	}
+	doc, err := p.client.GetInstanceIdentityDocument()
+	if err != nil {
+		return nil, err
+	}
+
+	vars := map[string]string{}
+	metadata := reflect.ValueOf(doc)
+	for i := 0; i < metadata.NumField(); i++ {
+		field := metadata.Field(i)
+		if field.Kind() != reflect.String {
+			continue
+		}
+		vars[metadata.Type().Field(i).Name] = field.String()
+	}
+
+	return &HostIdentity{
+		InstanceId: doc.InstanceID,
+		Region:     doc.Region,
+		Vars:       vars,
+	}, nil
+}
+
+// machineIdIdentityProvider uses the systemd machine id, which is what
+// identifies the host in its own journal.
+type machineIdIdentityProvider struct {
+	filename string
+}
+
+func (p *machineIdIdentityProvider) Name() string {
+	return "machine_id"
+}
+
+func (p *machineIdIdentityProvider) Identity() (*HostIdentity, error) {
+	data, err := ioutil.ReadFile(p.filename)
+	if err != nil {
+		return nil, err
+	}
+	machineId := strings.TrimSpace(string(data))
+	if machineId == "" {
+		return nil, fmt.Errorf("%s is empty", p.filename)
+	}
+
+	vars := map[string]string{
+		"MachineID": machineId,
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		vars["Hostname"] = hostname
+	}
+	return &HostIdentity{
+		InstanceId: machineId,
+		Vars:       vars,
+	}, nil
+}
+
+type hostnameIdentityProvider struct{}
+
+func (p *hostnameIdentityProvider) Name() string {
+	return "hostname"
+}
+
+func (p *hostnameIdentityProvider) Identity() (*HostIdentity, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &HostIdentity{
+		InstanceId: hostname,
+		Vars: map[string]string{
+			"Hostname": hostname,
+		},
+	}, nil
+}
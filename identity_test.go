@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeIMDS is a stand-in for the EC2 instance metadata service, serving
+// an instance identity document and IMDSv2 session tokens.
+type fakeIMDS struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// v1Only makes token requests fail, as with IMDSv1 only, and
+	// requireToken rejects requests without one, as with IMDSv2 only.
+	v1Only       bool
+	requireToken bool
+	// ttl, if set, is the lifetime in seconds given to tokens instead
+	// of the one requested.
+	ttl int
+
+	token          string
+	tokenRequests  int
+	requestedTTL   string
+	rejected       int
+	withToken      int
+	withoutToken   int
+	documentServed int
+}
+
+var fakeIdentityDocument = map[string]string{
+	"instanceId":       "i-0123456789abcdef0",
+	"availabilityZone": "eu-west-1a",
+	"region":           "eu-west-1",
+	"accountId":        "123456789012",
+	"instanceType":     "t3.micro",
+}
+
+func newFakeIMDS() *fakeIMDS {
+	f := &fakeIMDS{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeIMDS) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/latest/api/token" {
+		if r.Method != "PUT" || f.v1Only {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		f.tokenRequests++
+		f.requestedTTL = r.Header.Get(imdsTokenTTLHeader)
+		f.token = fmt.Sprintf("token-%d", f.tokenRequests)
+		ttl := f.requestedTTL
+		if f.ttl != 0 {
+			ttl = strconv.Itoa(f.ttl)
+		}
+		w.Header().Set(imdsTokenTTLHeader, ttl)
+		w.Write([]byte(f.token))
+		return
+	}
+
+	token := r.Header.Get(imdsTokenHeader)
+	if (token == "" && f.requireToken) || (token != "" && token != f.token) {
+		f.rejected++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if token == "" {
+		f.withoutToken++
+	} else {
+		f.withToken++
+	}
+
+	switch r.URL.Path {
+	case "/latest/dynamic/instance-identity/document":
+		f.documentServed++
+		json.NewEncoder(w).Encode(fakeIdentityDocument)
+	case "/latest/meta-data/placement/availability-zone":
+		w.Write([]byte(fakeIdentityDocument["availabilityZone"]))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// writeTestConfig writes a config file into a new temporary directory,
+// with the state file alongside it.
+func writeTestConfig(t *testing.T, format string, args ...interface{}) string {
+	t.Helper()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.hcl")
+	content := fmt.Sprintf("state_file = %q\n", filepath.Join(dir, "state")) + fmt.Sprintf(format, args...)
+	err := ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestEC2InstanceIdKeepsIdentityDocument(t *testing.T) {
+	imds := newFakeIMDS()
+	defer imds.Close()
+
+	filename := writeTestConfig(t, `
+log_group = "group"
+ec2_instance_id = "i-legacy"
+ec2_metadata_endpoint = %q
+strict_variables = true
+log_stream = "${instance.InstanceID}-${instance.AvailabilityZone}-${instance.AccountID}"
+`, imds.URL)
+
+	config, err := LoadConfig(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.InstanceId != "i-legacy" {
+		t.Errorf("instance id is %s, want the one given by ec2_instance_id", config.InstanceId)
+	}
+	if want := "i-legacy-eu-west-1a-123456789012"; config.LogStreamName != want {
+		t.Errorf("log stream is %s, want %s", config.LogStreamName, want)
+	}
+	if config.HostIdentity.Provider != "ec2" {
+		t.Errorf("host identified by %s, want ec2", config.HostIdentity.Provider)
+	}
+	if config.AWSRegion != "eu-west-1" {
+		t.Errorf("region is %s, want the instance's", config.AWSRegion)
+	}
+}
+
+func TestInstanceIdOverridesEC2InstanceId(t *testing.T) {
+	filename := writeTestConfig(t, `
+log_group = "group"
+ec2_instance_id = "i-legacy"
+aws_region = "eu-west-1"
+host_identity {
+    providers = ["static"]
+    instance_id = "rack4-db1"
+}
+`)
+
+	config, err := LoadConfigOffline(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.InstanceId != "rack4-db1" || config.HostIdentity.Provider != "static" {
+		t.Errorf("host identified as %s by %s, want rack4-db1 by static", config.InstanceId, config.HostIdentity.Provider)
+	}
+}
+
+func TestIdentityOffline(t *testing.T) {
+	tests := []struct {
+		providers string
+		want      bool
+	}{
+		{`["ec2", "hostname"]`, true},
+		{`["hostname", "ec2"]`, false},
+		{`["hostname"]`, false},
+	}
+	for _, test := range tests {
+		filename := writeTestConfig(t, `
+log_group = "group"
+aws_region = "eu-west-1"
+host_identity {
+    providers = %s
+}
+`, test.providers)
+
+		config, err := LoadConfigOffline(filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.IdentityOffline != test.want {
+			t.Errorf("with providers %s, IdentityOffline is %v", test.providers, config.IdentityOffline)
+		}
+	}
+}
+
+func TestLoadConfigForAWS(t *testing.T) {
+	imds := newFakeIMDS()
+	defer imds.Close()
+
+	filename := writeTestConfig(t, `
+log_group = "group"
+aws_region = "eu-west-1"
+ec2_metadata_endpoint = %q
+host_identity {
+    providers = ["ec2", "hostname"]
+}
+`, imds.URL)
+
+	config, err := LoadConfigForAWS(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.AWSCredentials == nil {
+		t.Errorf("no credentials were loaded")
+	}
+	if !config.IdentityOffline || config.HostIdentity.Provider != "hostname" {
+		t.Errorf("host identified by %s, want hostname without the metadata", config.HostIdentity.Provider)
+	}
+	if imds.documentServed != 0 {
+		t.Errorf("the identity document was fetched")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+const (
+	imdsTokenHeader    = "X-aws-ec2-metadata-token"
+	imdsTokenTTLHeader = "X-aws-ec2-metadata-token-ttl-seconds"
+
+	// imdsTokenRefreshWindow is how long before a session token expires
+	// that a new one is requested, so that it can't expire in flight.
+	imdsTokenRefreshWindow = time.Minute
+
+	defaultIMDSTokenTTL = 6 * time.Hour
+)
+
+// imdsTokenSource provides IMDSv2 session tokens for requests to the
+// instance metadata service, requesting a new token when the previous one
+// is close to expiry.
+type imdsTokenSource struct {
+	client     *http.Client
+	url        string
+	ttl        time.Duration
+	fallbackV1 bool
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// useIMDSv2 makes the given metadata client send a session token with
+// every request. If fallbackV1 is true then requests are sent without a
+// token when one can't be obtained, as IMDSv1 requests.
+func useIMDSv2(metaClient *ec2metadata.EC2Metadata, httpClient *http.Client, ttl time.Duration, fallbackV1 bool) {
+	s := &imdsTokenSource{
+		client:     httpClient,
+		url:        metaClient.ClientInfo.Endpoint + "/api/token",
+		ttl:        ttl,
+		fallbackV1: fallbackV1,
+	}
+	metaClient.Handlers.Sign.PushBack(s.sign)
+	metaClient.Handlers.Retry.PushBack(s.retry)
+}
+
+func (s *imdsTokenSource) sign(r *request.Request) {
+	token, err := s.get()
+	if err != nil {
+		if s.fallbackV1 {
+			r.HTTPRequest.Header.Del(imdsTokenHeader)
+			return
+		}
+		r.Error = awserr.New("EC2MetadataError", "unable to get IMDSv2 session token", err)
+		return
+	}
+	r.HTTPRequest.Header.Set(imdsTokenHeader, token)
+}
+
+// retry discards the token if the service rejected it, e.g. because it
+// was restarted, so that the request is retried with a new one.
+func (s *imdsTokenSource) retry(r *request.Request) {
+	if r.HTTPResponse == nil || r.HTTPResponse.StatusCode != http.StatusUnauthorized {
+		return
+	}
+	s.mu.Lock()
+	s.token = ""
+	s.mu.Unlock()
+	r.Retryable = aws.Bool(true)
+}
+
+func (s *imdsTokenSource) get() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Before(s.expires) {
+		return s.token, nil
+	}
+
+	req, err := http.NewRequest("PUT", s.url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(imdsTokenTTLHeader, strconv.Itoa(int(s.ttl/time.Second)))
+
+	requested := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			// The service drops responses to token requests that
+			// have crossed more hops than the instance allows,
+			// which looks like this from inside a container.
+			return "", fmt.Errorf("%s (if running in a container, the instance's metadata hop limit may need raising)", err)
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", &HTTPStatusError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+		}
+	}
+
+	ttl := s.ttl
+	if seconds, err := strconv.Atoi(resp.Header.Get(imdsTokenTTLHeader)); err == nil {
+		ttl = time.Duration(seconds) * time.Second
+	}
+	window := imdsTokenRefreshWindow
+	if ttl <= 2*window {
+		window = ttl / 2
+	}
+	s.token = string(body)
+	s.expires = requested.Add(ttl - window)
+	return s.token, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestMetadataClient(t *testing.T, imds *fakeIMDS, fallbackV1 bool) func() error {
+	t.Helper()
+	config := &Config{
+		AWSEndpoints:       AWSEndpoints{EC2Metadata: imds.URL},
+		MetadataTimeout:    time.Second,
+		MetadataTokenTTL:   defaultIMDSTokenTTL,
+		MetadataV1Fallback: fallbackV1,
+	}
+	client, err := config.NewMetadataClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() error {
+		_, err := client.GetInstanceIdentityDocument()
+		return err
+	}
+}
+
+// expireToken makes the service forget the token it issued, as if it had
+// been restarted.
+func (f *fakeIMDS) expireToken() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token = "expired"
+}
+
+func TestIMDSv2Token(t *testing.T) {
+	imds := newFakeIMDS()
+	defer imds.Close()
+	imds.requireToken = true
+	getDocument := newTestMetadataClient(t, imds, false)
+
+	for i := 0; i < 3; i++ {
+		if err := getDocument(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if imds.tokenRequests != 1 {
+		t.Errorf("requested %d tokens, want one to be reused", imds.tokenRequests)
+	}
+	if imds.requestedTTL != "21600" {
+		t.Errorf("requested a token for %s seconds", imds.requestedTTL)
+	}
+	if imds.withToken != 3 || imds.documentServed != 3 {
+		t.Errorf("%d requests had a token and %d were served, want 3", imds.withToken, imds.documentServed)
+	}
+}
+
+func TestIMDSv2TokenRefresh(t *testing.T) {
+	imds := newFakeIMDS()
+	defer imds.Close()
+	imds.requireToken = true
+	// The token is replaced halfway through such a short lifetime.
+	imds.ttl = 1
+	getDocument := newTestMetadataClient(t, imds, false)
+
+	if err := getDocument(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if err := getDocument(); err != nil {
+		t.Fatal(err)
+	}
+	if imds.tokenRequests != 2 {
+		t.Errorf("requested %d tokens, want the expiring one to be replaced", imds.tokenRequests)
+	}
+	if imds.rejected != 0 {
+		t.Errorf("%d requests were rejected", imds.rejected)
+	}
+}
+
+func TestIMDSv2RejectedToken(t *testing.T) {
+	imds := newFakeIMDS()
+	defer imds.Close()
+	imds.requireToken = true
+	getDocument := newTestMetadataClient(t, imds, false)
+
+	if err := getDocument(); err != nil {
+		t.Fatal(err)
+	}
+	imds.expireToken()
+	if err := getDocument(); err != nil {
+		t.Fatalf("not retried with a new token: %s", err)
+	}
+	if imds.rejected != 1 || imds.tokenRequests != 2 {
+		t.Errorf("%d requests rejected and %d tokens requested, want 1 and 2", imds.rejected, imds.tokenRequests)
+	}
+}
+
+func TestIMDSv1Fallback(t *testing.T) {
+	imds := newFakeIMDS()
+	defer imds.Close()
+	imds.v1Only = true
+
+	if err := newTestMetadataClient(t, imds, false)(); err == nil {
+		t.Errorf("got the document without a token, even though IMDSv1 isn't allowed")
+	}
+	if imds.withoutToken != 0 {
+		t.Errorf("sent %d requests without a token", imds.withoutToken)
+	}
+
+	if err := newTestMetadataClient(t, imds, true)(); err != nil {
+		t.Fatalf("didn't fall back to IMDSv1: %s", err)
+	}
+	if imds.withoutToken != 1 {
+		t.Errorf("sent %d requests without a token, want 1", imds.withoutToken)
+	}
+}
@@ -1,10 +1,50 @@
 package main
 
 import (
-	"github.com/coreos/go-systemd/sdjournal"
+	"fmt"
 	"strconv"
+	"strings"
+
+	"github.com/coreos/go-systemd/sdjournal"
 )
 
+// OpenJournal opens the configured journal with the configured filters.
+// If any systemd units are given, only their entries are read; a unit name
+// without a suffix is taken to be a service, as with journalctl.
+func OpenJournal(config *Config, units []string) (*sdjournal.Journal, error) {
+	var journal *sdjournal.Journal
+	var err error
+	if config.JournalDir == "" {
+		journal, err = sdjournal.NewJournal()
+	} else {
+		journal, err = sdjournal.NewJournalFromDir(config.JournalDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening journal: %s", err)
+	}
+
+	// Matches on different fields must be added together, before the
+	// disjunction that ends the log filters, for both to apply.
+	for _, unit := range units {
+		if !strings.Contains(unit, ".") {
+			unit += ".service"
+		}
+		journal.AddMatch("_SYSTEMD_UNIT=" + unit)
+	}
+	AddLogFilters(journal, config)
+	return journal, nil
+}
+
+// addReaderLogFilters adds the log filters for the daemon's reader. When
+// metrics are served, entries above log_priority are read and then dropped
+// by the reader instead, so that they can be counted.
+func addReaderLogFilters(journal *sdjournal.Journal, config *Config) {
+	if config.MetricsListen != "" {
+		return
+	}
+	AddLogFilters(journal, config)
+}
+
 func AddLogFilters(journal *sdjournal.Journal, config *Config) {
 
 	// Add Priority Filters
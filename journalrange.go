@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// JournalRange selects the journal entries that the backfill and verify
+// commands read. Zero values leave a bound open, but one of the lower
+// bounds is required.
+type JournalRange struct {
+	Since, Until time.Time
+
+	// AfterCursor excludes the entry with that cursor, like the cursor
+	// saved in the state file, while UntilCursor includes its entry.
+	AfterCursor, UntilCursor string
+
+	// Units, if any, limit the range to the entries of those systemd
+	// units.
+	Units []string
+}
+
+// Check returns an error if the range's bounds can't be used together.
+func (r JournalRange) Check() error {
+	if r.Since.IsZero() && r.AfterCursor == "" {
+		return fmt.Errorf("-since or -after-cursor is required")
+	} else if !r.Since.IsZero() && r.AfterCursor != "" {
+		return fmt.Errorf("-since and -after-cursor can't be used together")
+	} else if !r.Until.IsZero() && r.UntilCursor != "" {
+		return fmt.Errorf("-until and -until-cursor can't be used together")
+	}
+	return nil
+}
+
+// ReadRange calls fn with each record in the range that matches the
+// config's filters, in journal order, as the daemon would read it. It
+// stops at the first error that fn returns.
+func ReadRange(config *Config, r JournalRange, fn func(record *Record) error) error {
+	journal, err := OpenJournal(config, r.Units)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	if r.UntilCursor != "" && !seekCursor(journal, r.UntilCursor) {
+		// Otherwise we'd read to the end of the journal looking
+		// for it.
+		return fmt.Errorf("the -until-cursor entry isn't in the journal, or doesn't match the filters")
+	}
+
+	var seeked int
+	if r.AfterCursor != "" {
+		if !seekCursor(journal, r.AfterCursor) {
+			return fmt.Errorf("the -after-cursor entry isn't in the journal, or doesn't match the filters")
+		}
+		seeked, err = journal.Next()
+	} else {
+		err = journal.SeekRealtimeUsec(uint64(r.Since.UnixNano() / int64(time.Microsecond)))
+		if err == nil {
+			seeked, err = journal.Next()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to seek in journal: %s", err)
+	}
+
+	for seeked > 0 {
+		var record Record
+		err = UnmarshalRecord(journal, &record)
+		if err != nil {
+			return fmt.Errorf("error unmarshalling record: %s", err)
+		}
+		record.InstanceId = config.InstanceId
+		record.Cursor, _ = journal.GetCursor()
+		if config.IncludeCursor {
+			record.JournalCursor = record.Cursor
+		}
+
+		if !r.Until.IsZero() && !record.Time().Before(r.Until) {
+			return nil
+		}
+		// As in ReadRecords, the priority check is only a safety net.
+		if record.Priority <= config.LogPriority {
+			err = fn(&record)
+			if err != nil {
+				return err
+			}
+		}
+		if record.Cursor == r.UntilCursor {
+			return nil
+		}
+
+		seeked, err = journal.Next()
+		if err != nil {
+			return fmt.Errorf("error reading from journal: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/sdjournal"
+)
+
+const (
+	// maxLagEntries limits how far through the journal the lag is
+	// counted, so that measuring a large backlog doesn't take long.
+	maxLagEntries = 1000000
+
+	lagCountStep = 10000
+)
+
+// Lag is how far the last entry delivered to every output is behind the
+// last entry in the journal.
+type Lag struct {
+	Time    time.Duration
+	Entries uint64
+
+	// AtLeast is set if the entries stopped being counted at
+	// maxLagEntries.
+	AtLeast bool
+}
+
+// LagMonitor measures the lag with its own handle on the journal, which
+// has the same filters as the reader's, so only entries that will be
+// delivered are counted.
+type LagMonitor struct {
+	journal *sdjournal.Journal
+}
+
+func OpenLagMonitor(config *Config) (*LagMonitor, error) {
+	journal, err := OpenJournal(config, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LagMonitor{journal}, nil
+}
+
+func (m *LagMonitor) Close() error {
+	return m.journal.Close()
+}
+
+// Measure returns the lag of the entry with the given cursor.
+func (m *LagMonitor) Measure(cursor string) (Lag, error) {
+	var lag Lag
+
+	err := m.journal.SeekCursor(cursor)
+	if err != nil {
+		return lag, err
+	}
+	if _, err := m.journal.Next(); err != nil {
+		return lag, err
+	}
+	if m.journal.TestCursor(cursor) != nil {
+		return lag, fmt.Errorf("the last delivered entry is no longer in the journal")
+	}
+	delivered, err := m.journal.GetRealtimeUsec()
+	if err != nil {
+		return lag, err
+	}
+
+	lag.Entries, lag.AtLeast, err = countEntries(m.journal)
+	if err != nil || lag.Entries == 0 {
+		return lag, err
+	}
+
+	tail, err := m.journal.GetRealtimeUsec()
+	if err != nil {
+		return lag, err
+	}
+	if tail > delivered {
+		lag.Time = time.Duration(tail-delivered) * time.Microsecond
+	}
+	return lag, nil
+}
+
+// countEntries counts the entries after the journal's position, up to
+// maxLagEntries, and leaves the journal on the last entry. It returns
+// whether it stopped counting at the limit.
+func countEntries(journal *sdjournal.Journal) (uint64, bool, error) {
+	var count uint64
+	for count < maxLagEntries {
+		n, err := journal.NextSkip(lagCountStep)
+		if err != nil {
+			return count, false, err
+		}
+		count += n
+		if n < lagCountStep {
+			return count, false, nil
+		}
+	}
+
+	journal.SeekTail()
+	if _, err := journal.Previous(); err != nil {
+		return count, true, err
+	}
+	return count, true, nil
+}
+
+// StartLagMetrics measures the lag and throughput at the configured
+// interval and publishes them to Cloudwatch in Embedded Metric Format,
+// until the returned function is called. It does nothing if lag metrics
+// aren't configured.
+func StartLagMetrics(config *Config) (stop func(), err error) {
+	if config.LagMetrics == nil {
+		return func() {}, nil
+	}
+
+	monitor, err := OpenLagMonitor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	metricsConfig := config.LagMetrics
+	writer, err := config.NewEMFWriter(metricsConfig)
+	if err != nil {
+		monitor.Close()
+		return nil, err
+	}
+
+	dimensions := map[string]string{
+		"InstanceId": config.InstanceId,
+		"LogStream":  config.LogStreamName,
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer monitor.Close()
+
+		ticker := time.NewTicker(metricsConfig.Interval)
+		defer ticker.Stop()
+
+		lastShipped, _ := pipelineActivity.progress()
+		last := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				shipped, _ := pipelineActivity.progress()
+				throughput := float64(shipped-lastShipped) / now.Sub(last).Seconds()
+				lastShipped, last = shipped, now
+
+				err := publishLag(monitor, writer, metricsConfig.Namespace, dimensions, throughput, now)
+				if err != nil {
+					err = fmt.Errorf("Failed to publish lag metrics: %s", err)
+					log.Print(err)
+					pipelineActivity.failed(err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		wg.Wait()
+	}, nil
+}
+
+func publishLag(monitor *LagMonitor, writer *Writer, namespace string, dimensions map[string]string, throughput float64, now time.Time) error {
+	metrics := []EMFMetric{
+		{"RecordsPerSecond", "Count/Second", throughput},
+	}
+
+	// Until something has been delivered there's nothing to measure
+	// from.
+	if cursor := pipelineActivity.committed(); cursor != "" {
+		lag, err := monitor.Measure(cursor)
+		if err != nil {
+			return fmt.Errorf("unable to measure lag: %s", err)
+		}
+		pipelineActivity.setJournalLag(lag)
+		journalLagMetric.Set(lag.Time.Seconds())
+		journalLagEntriesMetric.Set(float64(lag.Entries))
+		metrics = append(metrics,
+			EMFMetric{"LagSeconds", "Seconds", lag.Time.Seconds()},
+			EMFMetric{"LagEntries", "Count", lag.Entries},
+		)
+	}
+
+	event, err := EncodeEMF(namespace, dimensions, metrics, now)
+	if err != nil {
+		return err
+	}
+	return writer.WriteBatch([]Record{{
+		Message:  string(event),
+		TimeUsec: now.UnixNano() / int64(time.Millisecond),
+	}})
+}
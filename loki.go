@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// lokiLabels maps the names accepted in the loki "labels" setting to the
+// record fields they're taken from. Only fields with few distinct values
+// are offered, since every distinct label set is a separate Loki stream.
+var lokiLabels = map[string]func(record *Record) string{
+	"unit": func(record *Record) string {
+		return record.SystemdUnit
+	},
+	"hostname": func(record *Record) string {
+		return record.Hostname
+	},
+	"priority": func(record *Record) string {
+		return strings.ToLower(strings.Trim(string(PriorityJSON[record.Priority]), `"`))
+	},
+	"transport": func(record *Record) string {
+		return record.Transport
+	},
+	"instance_id": func(record *Record) string {
+		return record.InstanceId
+	},
+}
+
+// LokiSink pushes records to a Grafana Loki server, grouped into streams
+// by a configurable set of labels.
+type LokiSink struct {
+	config *LokiSinkConfig
+	encode Encoder
+	poster *httpPoster
+}
+
+type lokiStream struct {
+	labels  map[string]string
+	key     string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	timestampNano int64
+	line          string
+}
+
+func NewLokiSink(config *LokiSinkConfig) (*LokiSink, error) {
+	encode, err := GetEncoder(config.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	poster, err := newHTTPPoster(config.TLS, config.Auth, config.MaxRetries)
+	if err != nil {
+		return nil, err
+	}
+	if config.TenantId != "" {
+		poster.headers["X-Scope-OrgID"] = config.TenantId
+	}
+
+	return &LokiSink{
+		config: config,
+		encode: encode,
+		poster: poster,
+	}, nil
+}
+
+func (s *LokiSink) Name() string {
+	return "loki " + s.config.URL
+}
+
+func (s *LokiSink) WriteBatch(records []Record) error {
+	streams, err := s.groupStreams(records)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	var contentType string
+	if s.config.Encoding == "json" {
+		body, err = lokiJSONBody(streams)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+	} else {
+		body = snappyEncode(lokiProtobufBody(streams))
+		contentType = "application/x-protobuf"
+	}
+
+	_, err = s.poster.post(s.config.URL+"/loki/api/v1/push", contentType, body)
+	return err
+}
+
+func (s *LokiSink) Close() error {
+	return nil
+}
+
+// groupStreams sorts the records into streams, keeping the streams in the
+// order that they first appear and the entries within each stream in
+// journal order.
+func (s *LokiSink) groupStreams(records []Record) ([]*lokiStream, error) {
+	var streams []*lokiStream
+	byKey := map[string]*lokiStream{}
+
+	for i := range records {
+		record := &records[i]
+
+		labels := make(map[string]string, len(s.config.StaticLabels)+len(s.config.Labels))
+		for k, v := range s.config.StaticLabels {
+			labels[k] = v
+		}
+		for _, name := range s.config.Labels {
+			if value := lokiLabels[name](record); value != "" {
+				labels[name] = value
+			}
+		}
+		key := lokiLabelString(labels)
+
+		stream, ok := byKey[key]
+		if !ok {
+			stream = &lokiStream{
+				labels: labels,
+				key:    key,
+			}
+			byKey[key] = stream
+			streams = append(streams, stream)
+		}
+
+		line, err := s.encode(record)
+		if err != nil {
+			return nil, err
+		}
+		stream.entries = append(stream.entries, lokiEntry{
+			timestampNano: record.Time().UnixNano(),
+			line:          string(line),
+		})
+	}
+
+	return streams, nil
+}
+
+// lokiLabelString renders a label set in the Prometheus selector syntax
+// that the protobuf push format uses, with the labels sorted by name.
+func lokiLabelString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + "=" + strconv.Quote(labels[name])
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func lokiJSONBody(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	body := struct {
+		Streams []jsonStream `json:"streams"`
+	}{
+		Streams: make([]jsonStream, len(streams)),
+	}
+	for i, stream := range streams {
+		values := make([][2]string, len(stream.entries))
+		for j, entry := range stream.entries {
+			values[j] = [2]string{
+				strconv.FormatInt(entry.timestampNano, 10),
+				entry.line,
+			}
+		}
+		body.Streams[i] = jsonStream{
+			Stream: stream.labels,
+			Values: values,
+		}
+	}
+
+	return json.Marshal(body)
+}
+
+// lokiProtobufBody encodes a logproto.PushRequest message.
+func lokiProtobufBody(streams []*lokiStream) []byte {
+	var body []byte
+	for _, stream := range streams {
+		// logproto.StreamAdapter
+		var msg []byte
+		msg = protoAppendStringField(msg, 1, stream.key)
+		for _, entry := range stream.entries {
+			// google.protobuf.Timestamp
+			var ts []byte
+			ts = protoAppendVarintField(ts, 1, uint64(entry.timestampNano/1e9))
+			ts = protoAppendVarintField(ts, 2, uint64(entry.timestampNano%1e9))
+
+			// logproto.EntryAdapter
+			var e []byte
+			e = protoAppendBytesField(e, 1, ts)
+			e = protoAppendStringField(e, 2, entry.line)
+
+			msg = protoAppendBytesField(msg, 2, e)
+		}
+		body = protoAppendBytesField(body, 1, msg)
+	}
+	return body
+}
+
+func validateLokiLabels(names []string) error {
+	for _, name := range names {
+		if _, ok := lokiLabels[name]; !ok {
+			return fmt.Errorf("'%s' is not a supported label", name)
+		}
+	}
+	return nil
+}
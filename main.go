@@ -5,11 +5,44 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/coreos/go-systemd/sdjournal"
 )
 
 var help = flag.Bool("help", false, "set to true to show this help")
+var printConfig = flag.Bool("print-config", false, "print the merged configuration and exit")
+var queryAWS = flag.Bool("aws", false, "let the status, tail and download commands and -dry-run identify the host with instance metadata; status also describes the Cloudwatch Logs streams")
+var dryRun = flag.Bool("dry-run", false, "print the events that would be sent, without sending them or updating the state file")
+var since = flag.String("since", "", "with tail, backfill, verify and download, start with the entries since this `time`, e.g. \"2006-01-02 15:04:05\" or 1h ago")
+var until = flag.String("until", "", "with backfill, verify and download, stop before the entries from this `time`")
+var afterCursor = flag.String("after-cursor", "", "with backfill and verify, start after the entry with this `cursor`")
+var untilCursor = flag.String("until-cursor", "", "with backfill and verify, stop after the entry with this `cursor`")
+var logGroup = flag.String("log-group", "", "with backfill, verify and download, the `log group` to use instead of log_group")
+var logStream = flag.String("stream", "", "with backfill, verify and download, the `log stream` to use instead of log_stream (with \"-backfill\" added for backfill)")
+var follow = flag.Bool("follow", false, "with tail, keep printing new entries as they arrive")
+var overrides settingsFlag
+var units settingsFlag
+
+func init() {
+	flag.Var(&overrides, "set", "override a config setting, as `name=value`; may be repeated")
+	flag.Var(&units, "unit", "with tail, backfill and verify, only read entries from this systemd `unit`; may be repeated")
+}
+
+// settingsFlag collects the values of a flag that can be given many times.
+type settingsFlag []string
+
+func (f *settingsFlag) String() string {
+	return strings.Join(*f, " ")
+}
+
+func (f *settingsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
 
 func main() {
 	flag.Parse()
@@ -19,13 +52,31 @@ func main() {
 		os.Exit(0)
 	}
 
+	command := run
+	if name := flag.Arg(0); commands[name] != nil {
+		// Options may also follow the command name.
+		command = commands[name]
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
 	configFilename := flag.Arg(0)
 	if configFilename == "" {
 		usage()
 		os.Exit(1)
 	}
 
-	err := run(configFilename)
+	if *printConfig {
+		root, err := ReadConfigFiles(configFilename, overrides)
+		if err != nil {
+			os.Stderr.WriteString(err.Error())
+			os.Stderr.Write([]byte{'\n'})
+			os.Exit(2)
+		}
+		os.Stdout.Write(FormatConfig(root))
+		os.Exit(0)
+	}
+
+	err := command(configFilename)
 	if err != nil {
 		os.Stderr.WriteString(err.Error())
 		os.Stderr.Write([]byte{'\n'})
@@ -33,18 +84,120 @@ func main() {
 	}
 }
 
+// commands are the alternatives to running normally, selected by the
+// first argument.
+var commands = map[string]func(configFilename string) error{
+	"check-config": checkConfig,
+	"status":       showStatus,
+	"tail":         tail,
+	"backfill":     backfill,
+	"verify":       verify,
+	"download":     download,
+}
+
 func usage() {
-	os.Stderr.WriteString("Usage: journald-cloudwatch-logs <config-file>\n\n")
+	os.Stderr.WriteString("Usage: journald-cloudwatch-logs [command] [options] <config-file-or-dir>\n\n")
+	os.Stderr.WriteString("Commands:\n")
+	os.Stderr.WriteString("  check-config\tcheck the config and print it with variables expanded\n")
+	os.Stderr.WriteString("  status\t\tshow the saved position, the backlog and the outputs\n")
+	os.Stderr.WriteString("  tail\t\tprint the events that would be sent for the latest entries\n")
+	os.Stderr.WriteString("  backfill\tsend the entries in a range of the journal again\n")
+	os.Stderr.WriteString("  verify\t\tcheck that a range of the journal is in Cloudwatch Logs\n")
+	os.Stderr.WriteString("  download\twrite a Cloudwatch Logs stream out in Journal Export Format\n\n")
 	flag.PrintDefaults()
 	os.Stderr.WriteString("\n")
 }
 
+func checkConfig(configFilename string) error {
+	return CheckConfig(os.Stdout, configFilename, overrides)
+}
+
+func showStatus(configFilename string) error {
+	return ShowStatus(os.Stdout, configFilename, overrides, *queryAWS)
+}
+
+func tail(configFilename string) error {
+	return Tail(os.Stdout, configFilename, overrides, *queryAWS, *since, *follow, units)
+}
+
+func backfill(configFilename string) error {
+	r, err := journalRangeFlags()
+	if err != nil {
+		return err
+	}
+	return Backfill(os.Stdout, configFilename, overrides, BackfillOptions{
+		JournalRange:  r,
+		LogGroupName:  *logGroup,
+		LogStreamName: *logStream,
+	})
+}
+
+func verify(configFilename string) error {
+	r, err := journalRangeFlags()
+	if err != nil {
+		return err
+	}
+	return Verify(os.Stdout, configFilename, overrides, VerifyOptions{
+		JournalRange:  r,
+		LogGroupName:  *logGroup,
+		LogStreamName: *logStream,
+	})
+}
+
+func download(configFilename string) error {
+	r, err := journalRangeFlags()
+	if err != nil {
+		return err
+	}
+	return Download(os.Stdout, configFilename, overrides, *queryAWS, DownloadOptions{
+		Since:         r.Since,
+		Until:         r.Until,
+		LogGroupName:  *logGroup,
+		LogStreamName: *logStream,
+	})
+}
+
+// journalRangeFlags returns the range of the journal given by the options.
+func journalRangeFlags() (JournalRange, error) {
+	r := JournalRange{
+		AfterCursor: *afterCursor,
+		UntilCursor: *untilCursor,
+		Units:       units,
+	}
+	now := time.Now()
+	var err error
+	if *since != "" {
+		r.Since, err = parseTime(*since, now)
+		if err != nil {
+			return r, err
+		}
+	}
+	if *until != "" {
+		r.Until, err = parseTime(*until, now)
+		if err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
 func run(configFilename string) error {
-	config, err := LoadConfig(configFilename)
+	if *dryRun {
+		return DryRun(os.Stdout, configFilename, overrides, *queryAWS)
+	}
+
+	config, err := LoadConfig(configFilename, overrides)
 	if err != nil {
 		return fmt.Errorf("error reading config: %s", err)
 	}
 
+	if config.MetricsListen != "" {
+		err = ServeMetrics(config.MetricsListen)
+		if err != nil {
+			return err
+		}
+	}
+
 	var journal *sdjournal.Journal
 	if config.JournalDir == "" {
 		journal, err = sdjournal.NewJournal()
@@ -58,86 +211,291 @@ func run(configFilename string) error {
 	}
 	defer journal.Close()
 
-	AddLogFilters(journal, config)
+	addReaderLogFilters(journal, config)
 
 	state, err := OpenState(config.StateFilename)
 	if err != nil {
 		return fmt.Errorf("Failed to open %s: %s", config.StateFilename, err)
 	}
 
-	lastBootId, nextSeq := state.LastState()
-
-	awsSession := config.NewAWSSession()
+	lastBootId, nextSeq, cursor := state.LastState()
 
-	writer, err := NewWriter(
-		awsSession,
-		config.LogGroupName,
-		config.LogStreamName,
-		nextSeq,
-	)
+	lanes, writer, err := openLanes(config, nextSeq)
 	if err != nil {
-		return fmt.Errorf("error initializing writer: %s", err)
+		return err
 	}
+	defer func() {
+		closeLanes(lanes)
+	}()
 
-	seeked, err := journal.Next()
-	if seeked == 0 || err != nil {
-		return fmt.Errorf("unable to seek to first item in journal")
+	bootId, resume, err := seekResume(journal, lastBootId, cursor)
+	if err != nil {
+		return err
 	}
-
-	bootId, err := journal.GetData("_BOOT_ID")
-	bootId = bootId[9:] // Trim off "_BOOT_ID=" prefix
-
-	// If the boot id has changed since our last run then we'll start from
-	// the beginning of the stream, but if we're starting up with the same
-	// boot id then we'll seek to the end of the stream to avoid repeating
-	// anything. However, we will miss any items that were added while we
-	// weren't running.
 	skip := uint64(0)
-	if bootId == lastBootId {
-		// If we're still in the same "boot" as we were last time then
-		// we were stopped and started again, so we'll seek to the last
-		// item in the log as an approximation of resuming streaming,
-		// though we will miss any logs that were added while we were
-		// running.
-		journal.SeekTail()
-		// Skip the last item so our log will resume only when we get
-		// the *next item.
+	if resume != resumeAtHead {
+		// The journal is positioned on the entry we last delivered,
+		// or the last one in the journal, so skip it.
 		skip = 1
 	}
 
-	err = state.SetState(bootId, nextSeq)
+	err = state.SetState(bootId, nextSeq, cursor)
 	if err != nil {
 		return fmt.Errorf("Failed to write state: %s", err)
 	}
 
+	if config.StatusListen != "" {
+		err = ServeStatus(config.StatusListen, bootId)
+		if err != nil {
+			return err
+		}
+	}
+
 	bufSize := config.BufferSize
 
 	records := make(chan Record)
 	batches := make(chan []Record)
+	readerConfigs := make(chan *Config, 1)
 
-	go ReadRecords(config.EC2InstanceId, journal, records, skip)
+	go ReadRecords(config, journal, records, skip, true, readerConfigs)
 	go BatchRecords(records, batches, bufSize)
 
-	for batch := range batches {
-
-		nextSeq, err = writer.WriteBatch(batch)
-		if err != nil {
-			return fmt.Errorf("Failed to write to cloudwatch: %s", err)
+	// Once every destination has accepted a batch, and all the batches
+	// before it, it's safe to move our saved position past it.
+	notifier := NewNotifier()
+	commit := func(cursor string) error {
+		if writer != nil {
+			nextSeq = writer.SequenceToken()
 		}
+		return state.SetState(bootId, nextSeq, cursor)
+	}
+	pipeline := NewPipeline(
+		lanes,
+		config.MaxConcurrentRequests,
+		config.MaxPendingBatches,
+		cursor,
+		commit,
+	)
 
-		err = state.SetState(bootId, nextSeq)
-		if err != nil {
-			return fmt.Errorf("Failed to write state: %s", err)
+	stopNotifier := make(chan struct{})
+	defer close(stopNotifier)
+	go notifier.Run(stopNotifier)
+
+	stopLagMetrics, err := StartLagMetrics(config)
+	if err != nil {
+		return fmt.Errorf("unable to start lag metrics: %s", err)
+	}
+	defer func() {
+		stopLagMetrics()
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+loop:
+	for {
+		select {
+		case batch, more := <-batches:
+			if !more {
+				break loop
+			}
+			err = pipeline.Submit(batch)
+			if err != nil {
+				break loop
+			}
+
+		case <-hup:
+			// Every batch goes either to the old outputs or to the
+			// new ones, so the old ones are allowed to finish
+			// first, and the new ones carry on from where they
+			// stopped.
+			notifier.Notify("RELOADING=1")
+			var newConfig *Config
+			newConfig, err = LoadConfig(configFilename, overrides)
+			if err != nil {
+				err = pipeline.Submit([]Record{synthRecord(
+					fmt.Errorf("Not reloading invalid config: %s", err),
+				)})
+				if err != nil {
+					break loop
+				}
+				notifier.Notify("READY=1")
+				continue
+			}
+
+			err = pipeline.Close()
+			if err != nil {
+				return err
+			}
+
+			var report Record
+			var newLanes []LaneConfig
+			var newWriter *Writer
+			newLanes, newWriter, err = openLanes(newConfig, sequenceTokenFor(newConfig, config, writer))
+			if err != nil {
+				report = synthRecord(fmt.Errorf("Not reloading config: %s", err))
+			} else {
+				report = reloadRecord(newConfig, config)
+				closeLanes(lanes)
+				config, lanes, writer = newConfig, newLanes, newWriter
+
+				stopLagMetrics()
+				stopLagMetrics, err = StartLagMetrics(config)
+				if err != nil {
+					report = synthRecord(fmt.Errorf("Reloaded config, but unable to start lag metrics: %s", err))
+					stopLagMetrics = func() {}
+				}
+
+				select {
+				case <-readerConfigs:
+				default:
+				}
+				readerConfigs <- config
+			}
+
+			pipeline = NewPipeline(
+				lanes,
+				config.MaxConcurrentRequests,
+				config.MaxPendingBatches,
+				pipeline.Cursor(),
+				commit,
+			)
+			err = pipeline.Submit([]Record{report})
+			if err != nil {
+				break loop
+			}
+			notifier.Notify("READY=1")
 		}
+	}
+	notifier.Notify("STOPPING=1")
 
+	// We fall out here when interrupted by a signal, or when a write
+	// has failed. Either way we wait for the writes in flight to finish.
+	err = pipeline.Close()
+	if err != nil {
+		return err
 	}
 
-	// We fall out here when interrupted by a signal.
 	// Last chance to write the state.
-	err = state.SetState(bootId, nextSeq)
+	if writer != nil {
+		nextSeq = writer.SequenceToken()
+	}
+	err = state.SetState(bootId, nextSeq, pipeline.Cursor())
 	if err != nil {
 		return fmt.Errorf("Failed to write state on exit: %s", err)
 	}
 
 	return nil
 }
+
+// openLanes creates the writers and sinks for every output in the given
+// config. The main Cloudwatch Logs stream's writer is also returned, if
+// there is one, so that its sequence token can be saved.
+func openLanes(config *Config, firstSeqToken string) ([]LaneConfig, *Writer, error) {
+	var lanes []LaneConfig
+	fail := func(err error) ([]LaneConfig, *Writer, error) {
+		closeLanes(lanes)
+		return nil, nil, err
+	}
+
+	var writer *Writer
+	if config.LogGroupName != "" || len(config.Destinations) > 0 {
+		cwClient := config.NewCloudWatchClient(config.NewAWSSession())
+
+		if config.LogGroupName != "" {
+			var err error
+			writer, err = NewWriter(
+				cwClient,
+				config.LogGroupName,
+				config.LogStreamName,
+				firstSeqToken,
+				config.Format,
+				config.UseSeqTokens,
+			)
+			if err != nil {
+				return fail(fmt.Errorf("error initializing writer: %s", err))
+			}
+			lanes = append(lanes, LaneConfig{
+				Sink:                 writer,
+				MaxRequestsPerSecond: config.MaxRequestsPerSecond,
+			})
+		}
+
+		// We only keep the sequence token of the main stream, so the
+		// others must find theirs again after a restart.
+		for _, dest := range config.Destinations {
+			destClient := cwClient
+			if dest.AWSCredentials != nil {
+				destClient = config.NewCloudWatchClient(config.NewAWSSessionWithCredentials(dest.AWSCredentials))
+			}
+			destWriter, err := NewWriter(
+				destClient,
+				dest.LogGroupName,
+				dest.LogStreamName,
+				"",
+				config.Format,
+				config.UseSeqTokens,
+			)
+			if err != nil {
+				return fail(fmt.Errorf("error initializing writer for %s: %s", dest.Name, err))
+			}
+			lanes = append(lanes, LaneConfig{
+				Sink:                 destWriter,
+				MaxRequestsPerSecond: dest.MaxRequestsPerSecond,
+			})
+		}
+	}
+
+	sinks, err := OpenSinks(config)
+	if err != nil {
+		return fail(err)
+	}
+	for _, sink := range sinks {
+		lanes = append(lanes, LaneConfig{Sink: sink})
+	}
+
+	return lanes, writer, nil
+}
+
+func closeLanes(lanes []LaneConfig) {
+	for _, lane := range lanes {
+		lane.Sink.Close()
+	}
+}
+
+// sequenceTokenFor returns the sequence token to start the new config's
+// main stream with, which is only known if it's the same stream as before.
+func sequenceTokenFor(config, oldConfig *Config, oldWriter *Writer) string {
+	if oldWriter == nil || config.LogGroupName != oldConfig.LogGroupName || config.LogStreamName != oldConfig.LogStreamName {
+		return ""
+	}
+	return oldWriter.SequenceToken()
+}
+
+// reloadRecord produces a synthetic record reporting that the config has
+// been reloaded, and which changes won't take effect until a restart.
+func reloadRecord(config, oldConfig *Config) Record {
+	var restart []string
+	if config.StateFilename != oldConfig.StateFilename {
+		restart = append(restart, "state_file")
+	}
+	if config.JournalDir != oldConfig.JournalDir {
+		restart = append(restart, "journal_dir")
+	}
+	if config.BufferSize != oldConfig.BufferSize {
+		restart = append(restart, "buffer_size")
+	}
+	if config.MetricsListen != oldConfig.MetricsListen {
+		restart = append(restart, "metrics_listen")
+	}
+	if config.StatusListen != oldConfig.StatusListen {
+		restart = append(restart, "status_listen")
+	}
+
+	message := "Reloaded config"
+	if len(restart) > 0 {
+		message += "; changes to " + strings.Join(restart, ", ") + " will take effect after a restart"
+	}
+	return noticeRecord(message)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const metricsNamespace = "journald_cloudwatch_logs_"
+
+// The metrics describing the shipping pipeline. They're always collected,
+// but only exposed if metrics_listen is set.
+var (
+	recordsReadMetric = newCounterVec(
+		"records_read_total",
+		"Records read from the journal.",
+		"unit",
+	)
+	recordsFilteredMetric = newCounterVec(
+		"records_filtered_total",
+		"Records read from the journal that were dropped by the priority filter.",
+		"unit",
+	)
+	recordsShippedMetric = newCounterVec(
+		"records_shipped_total",
+		"Records accepted by Cloudwatch Logs.",
+		"destination", "unit",
+	)
+	encodedBytesMetric = newCounterVec(
+		"encoded_bytes_total",
+		"Bytes of encoded events sent to Cloudwatch Logs.",
+		"destination",
+	)
+	batchSizeMetric = newHistogramVec(
+		"batch_records",
+		"Number of records in each batch.",
+		[]float64{1, 5, 10, 50, 100, 500, 1000, 5000, 10000},
+	)
+	putLatencyMetric = newHistogramVec(
+		"put_log_events_duration_seconds",
+		"Time taken by PutLogEvents requests.",
+		[]float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		"destination",
+	)
+	eventsRejectedMetric = newCounterVec(
+		"events_rejected_total",
+		"Events that Cloudwatch Logs wouldn't store, or that were left out because it wouldn't, by reason.",
+		"destination", "reason",
+	)
+	putErrorsMetric = newCounterVec(
+		"put_log_events_errors_total",
+		"Failed PutLogEvents requests, by AWS error code.",
+		"destination", "code",
+	)
+	pendingBatchesMetric = newGaugeVec(
+		"pending_batches",
+		"Batches waiting to be written to every destination.",
+	)
+	ackLagMetric = newGaugeVec(
+		"ack_lag_seconds",
+		"Time between the last delivered record being logged and every destination accepting it.",
+	)
+	lastAckMetric = newGaugeVec(
+		"last_ack_timestamp_seconds",
+		"When the last delivered record was accepted by every destination, as a Unix time.",
+	)
+	journalLagMetric = newGaugeVec(
+		"journal_lag_seconds",
+		"Time between the last delivered journal entry and the last entry in the journal, if lag metrics are enabled.",
+	)
+	journalLagEntriesMetric = newGaugeVec(
+		"journal_lag_entries",
+		"Journal entries after the last delivered one, if lag metrics are enabled.",
+	)
+)
+
+// metricsRegistry holds every metric, in the order they're exposed.
+var metricsRegistry []metric
+
+type metric interface {
+	writeMetric(w io.Writer)
+}
+
+// metricVec is a counter or gauge with a value for each combination of
+// its labels' values.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*metricValue
+}
+
+type metricValue struct {
+	labels []string
+	value  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *metricVec {
+	return registerMetricVec(name, help, "counter", labels)
+}
+
+func newGaugeVec(name, help string, labels ...string) *metricVec {
+	return registerMetricVec(name, help, "gauge", labels)
+}
+
+func registerMetricVec(name, help, kind string, labels []string) *metricVec {
+	m := &metricVec{
+		name:   metricsNamespace + name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: map[string]*metricValue{},
+	}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+// Add adds delta to the value with the given label values, which must be
+// given in the same order as the metric's labels.
+func (m *metricVec) Add(delta float64, labels ...string) {
+	m.mu.Lock()
+	m.get(labels).value += delta
+	m.mu.Unlock()
+}
+
+func (m *metricVec) Set(value float64, labels ...string) {
+	m.mu.Lock()
+	m.get(labels).value = value
+	m.mu.Unlock()
+}
+
+func (m *metricVec) get(labels []string) *metricValue {
+	key := strings.Join(labels, "\x00")
+	v, ok := m.values[key]
+	if !ok {
+		v = &metricValue{labels: append([]string(nil), labels...)}
+		m.values[key] = v
+	}
+	return v
+}
+
+func (m *metricVec) writeMetric(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetricHeader(w, m.name, m.help, m.kind)
+	for _, key := range sortedMetricKeys(m.values) {
+		v := m.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatMetricLabels(m.labels, v.labels), formatMetricValue(v.value))
+	}
+}
+
+// histogramVec counts observations into buckets, with a histogram for
+// each combination of its labels' values.
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    metricsNamespace + name,
+		help:    help,
+		buckets: buckets,
+		labels:  labels,
+		values:  map[string]*histogramValue{},
+	}
+	metricsRegistry = append(metricsRegistry, h)
+	return h
+}
+
+func (h *histogramVec) Observe(value float64, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := strings.Join(labels, "\x00")
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{
+			labels: append([]string(nil), labels...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = v
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+func (h *histogramVec) writeMetric(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeMetricHeader(w, h.name, h.help, "histogram")
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range sortedMetricKeys(h.values) {
+		v := h.values[key]
+		for i, bound := range h.buckets {
+			values := append(append([]string(nil), v.labels...), formatMetricValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatMetricLabels(bucketLabels, values), v.counts[i])
+		}
+		values := append(append([]string(nil), v.labels...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatMetricLabels(bucketLabels, values), v.count)
+		labels := formatMetricLabels(h.labels, v.labels)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels, formatMetricValue(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels, v.count)
+	}
+}
+
+func sortedMetricKeys(values interface{}) []string {
+	var keys []string
+	switch values := values.(type) {
+	case map[string]*metricValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// formatMetricLabels formats label names and values in the Prometheus text
+// format, like {unit="sshd.service"}.
+func formatMetricLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	parts := make([]string, len(names))
+	for i, name := range names {
+		parts[i] = name + `="` + replacer.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatMetricValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// WriteMetrics writes every metric in the Prometheus text exposition
+// format.
+func WriteMetrics(w io.Writer) error {
+	buf := bufio.NewWriter(w)
+	for _, m := range metricsRegistry {
+		m.writeMetric(buf)
+	}
+	return buf.Flush()
+}
+
+// ServeMetrics exposes the metrics at /metrics on the given address (see
+// listenLocal), returning once it's listening.
+func ServeMetrics(address string) error {
+	listener, err := listenLocal(address)
+	if err != nil {
+		return fmt.Errorf("unable to listen for metrics requests: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w)
+	})
+	server := &http.Server{
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	return nil
+}
+
+// observeAck records that the given batch has been accepted by every
+// destination.
+func observeAck(records []Record) {
+	if len(records) == 0 {
+		return
+	}
+	now := time.Now()
+	lag := now.Sub(records[len(records)-1].Time())
+	if lag < 0 {
+		lag = 0
+	}
+	ackLagMetric.Set(lag.Seconds())
+	lastAckMetric.Set(float64(now.UnixNano()) / float64(time.Second))
+}
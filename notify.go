@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// statusInterval is how often the status shown by systemctl is updated
+// when there's no watchdog to set the pace.
+const statusInterval = 10 * time.Second
+
+// Notifier reports the service's state to systemd, for services with
+// Type=notify: when it's ready, its status, and, if WatchdogSec is set,
+// that it's still making progress. A nil Notifier, as returned when we're
+// not running under systemd, does nothing.
+type Notifier struct {
+	addr     *net.UnixAddr
+	watchdog time.Duration
+	ready    sync.Once
+}
+
+// NewNotifier returns a notifier for the socket systemd gave us, or nil if
+// there isn't one.
+func NewNotifier() *Notifier {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	n := &Notifier{
+		addr: &net.UnixAddr{Name: socket, Net: "unixgram"},
+	}
+
+	// The watchdog settings are inherited by child processes, so they
+	// only apply to us if the pid matches, when it's given.
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid == "" || pid == strconv.Itoa(os.Getpid()) {
+		usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+		if err == nil && usec > 0 {
+			n.watchdog = time.Duration(usec) * time.Microsecond
+		}
+	}
+	return n
+}
+
+// Notify sends the given state, such as "READY=1", to systemd.
+func (n *Notifier) Notify(state string) error {
+	if n == nil {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ready tells systemd that the service has started, the first time it's
+// called. Run calls it once the pipeline is ready.
+func (n *Notifier) Ready() {
+	if n == nil {
+		return
+	}
+	n.ready.Do(func() {
+		n.Notify("READY=1")
+	})
+}
+
+// Run tells systemd that the service is ready once something has been
+// delivered, or there was nothing to deliver, and then periodically
+// updates the service's status with the current throughput and lag, and
+// pings the watchdog as long as neither the reader nor the outputs have
+// stalled, until stop is closed.
+func (n *Notifier) Run(stop <-chan struct{}) {
+	if n == nil {
+		return
+	}
+
+	interval := statusInterval
+	if n.watchdog > 0 {
+		// systemd recommends pinging at half the timeout.
+		interval = n.watchdog / 2
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastShipped, _ := pipelineActivity.progress()
+	last := time.Now()
+	ready := pipelineActivity.whenReady()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ready:
+			n.Ready()
+			ready = nil
+		case now := <-ticker.C:
+			if n.watchdog > 0 {
+				if err := pipelineActivity.stalled(now, n.watchdog); err != nil {
+					// Without the ping, systemd will restart us.
+					n.Notify("STATUS=Stalled: " + err.Error())
+					continue
+				}
+				n.Notify("WATCHDOG=1")
+			}
+
+			shipped, lag := pipelineActivity.progress()
+			rate := float64(shipped-lastShipped) / now.Sub(last).Seconds()
+			lastShipped, last = shipped, now
+			n.Notify(fmt.Sprintf("STATUS=Shipping %.1f records/s, %s behind the journal", rate, lag.Round(time.Millisecond)))
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifySocket is a stand-in for the socket systemd gives services
+// with Type=notify.
+type fakeNotifySocket struct {
+	t    *testing.T
+	conn *net.UnixConn
+}
+
+func newFakeNotifySocket(t *testing.T) *fakeNotifySocket {
+	t.Helper()
+	addr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "notify"), Net: "unixgram"}
+	conn, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", addr.Name)
+	return &fakeNotifySocket{t, conn}
+}
+
+// read returns the next message, or "" if none arrives in time.
+func (s *fakeNotifySocket) read(timeout time.Duration) string {
+	buf := make([]byte, 4096)
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := s.conn.Read(buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
+
+// expect waits for a message starting with prefix, returning the messages
+// received before it.
+func (s *fakeNotifySocket) expect(prefix string) []string {
+	s.t.Helper()
+	var before []string
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		message := s.read(time.Until(deadline))
+		if strings.HasPrefix(message, prefix) {
+			return before
+		}
+		if message != "" {
+			before = append(before, message)
+		}
+	}
+	s.t.Fatalf("no %s message, only %q", prefix, before)
+	return nil
+}
+
+// useTestActivity replaces the pipeline's activity for the rest of the
+// test.
+func useTestActivity(t *testing.T) *activity {
+	saved := pipelineActivity
+	pipelineActivity = newActivity()
+	t.Cleanup(func() { pipelineActivity = saved })
+	return pipelineActivity
+}
+
+func TestNotifierDisabled(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	n := NewNotifier()
+	if n != nil {
+		t.Fatalf("got a notifier without a socket")
+	}
+	// A nil notifier does nothing.
+	n.Ready()
+	if err := n.Notify("READY=1"); err != nil {
+		t.Error(err)
+	}
+	n.Run(nil)
+}
+
+func TestNotifierStates(t *testing.T) {
+	socket := newFakeNotifySocket(t)
+	n := NewNotifier()
+	if n == nil {
+		t.Fatal("no notifier")
+	}
+
+	for _, state := range []string{"READY=1", "RELOADING=1", "READY=1", "STOPPING=1"} {
+		if err := n.Notify(state); err != nil {
+			t.Fatal(err)
+		}
+		if got := socket.read(time.Second); got != state {
+			t.Errorf("sent %q, got %q", state, got)
+		}
+	}
+
+	// READY is only sent once by Ready.
+	n.Ready()
+	n.Ready()
+	if got := socket.read(time.Second); got != "READY=1" {
+		t.Errorf("got %q, want READY=1", got)
+	}
+	if got := socket.read(50 * time.Millisecond); got != "" {
+		t.Errorf("got %q after READY", got)
+	}
+}
+
+func TestNotifierWatchdogPid(t *testing.T) {
+	newFakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "2000000")
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if n := NewNotifier(); n.watchdog != 2*time.Second {
+		t.Errorf("watchdog is %s, want 2s", n.watchdog)
+	}
+
+	// The settings were meant for another process.
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if n := NewNotifier(); n.watchdog != 0 {
+		t.Errorf("watchdog is %s for another process", n.watchdog)
+	}
+}
+
+func TestNotifierRun(t *testing.T) {
+	socket := newFakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "200000")
+	t.Setenv("WATCHDOG_PID", "")
+	a := useTestActivity(t)
+
+	n := NewNotifier()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		n.Run(stop)
+		close(done)
+	}()
+
+	// The watchdog is pinged, but READY waits for the pipeline.
+	for _, message := range socket.expect("WATCHDOG=1") {
+		if message == "READY=1" {
+			t.Fatalf("ready before anything happened")
+		}
+	}
+	a.read()
+	a.nothingToDeliver()
+	socket.expect("READY=1")
+	socket.expect("STATUS=Shipping")
+
+	// A reader that stops reading is reported, and the pings stop.
+	a.mu.Lock()
+	a.lastRead = time.Now().Add(-time.Second)
+	a.mu.Unlock()
+	socket.expect("STATUS=Stalled: the journal hasn't been read")
+	for i := 0; i < 3; i++ {
+		if message := socket.read(150 * time.Millisecond); message == "WATCHDOG=1" {
+			t.Fatalf("watchdog pinged while stalled")
+		}
+	}
+
+	close(stop)
+	<-done
+}
+
+func TestNotifierReadyAfterDelivery(t *testing.T) {
+	socket := newFakeNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "")
+	a := useTestActivity(t)
+
+	n := NewNotifier()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		n.Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	// The reader has caught up, but what it sent hasn't been delivered.
+	a.setCaughtUp(true)
+	if message := socket.read(100 * time.Millisecond); message != "" {
+		t.Fatalf("got %q before anything was delivered", message)
+	}
+	a.acked("c1", []Record{{Cursor: "c1", TimeUsec: time.Now().UnixNano() / 1e6}})
+	if message := socket.read(time.Second); message != "READY=1" {
+		t.Fatalf("got %q, want READY=1", message)
+	}
+}
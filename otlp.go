@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const otlpGRPCPath = "/opentelemetry.proto.collector.logs.v1.LogsService/Export"
+
+// otlpSeverity maps journal priorities to OpenTelemetry severity numbers,
+// following the syslog mapping in the OpenTelemetry log data model.
+var otlpSeverity = map[Priority]uint64{
+	EMERGENCY: 24, // FATAL4
+	ALERT:     23, // FATAL3
+	CRITICAL:  21, // FATAL
+	ERROR:     17, // ERROR
+	WARNING:   13, // WARN
+	NOTICE:    10, // INFO2
+	INFO:      9,  // INFO
+	DEBUG:     5,  // DEBUG
+}
+
+// otlpResourceFields are the journal fields that describe where an entry
+// came from rather than the entry itself, and so are sent as resource
+// attributes instead of log record attributes.
+var otlpResourceFields = map[string]string{
+	"_HOSTNAME":   "host.name",
+	"_BOOT_ID":    "host.boot_id",
+	"_MACHINE_ID": "host.machine_id",
+}
+
+// OTLPSink exports records as OpenTelemetry log records, over either
+// OTLP/HTTP or OTLP/gRPC.
+type OTLPSink struct {
+	config *OTLPSinkConfig
+	client *http.Client
+	url    string
+}
+
+// grpcStatusError is returned when a gRPC call completes with a status
+// other than OK.
+type grpcStatusError struct {
+	code    int
+	message string
+}
+
+func (e *grpcStatusError) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", e.code, e.message)
+}
+
+func (e *grpcStatusError) retryable() bool {
+	switch e.code {
+	case 1, 4, 8, 10, 11, 14, 15:
+		// CANCELLED, DEADLINE_EXCEEDED, RESOURCE_EXHAUSTED, ABORTED,
+		// OUT_OF_RANGE, UNAVAILABLE, DATA_LOSS
+		return true
+	}
+	return false
+}
+
+func NewOTLPSink(config *OTLPSinkConfig) (*OTLPSink, error) {
+	tlsConfig, err := config.TLS.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   tlsConfig,
+		ForceAttemptHTTP2: true,
+	}
+
+	s := &OTLPSink{
+		config: config,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   httpRequestTimeout,
+		},
+	}
+
+	if config.Protocol == "grpc" {
+		err = useHTTP2Only(transport, strings.HasPrefix(config.Endpoint, "http://"))
+		if err != nil {
+			return nil, err
+		}
+		s.url = config.Endpoint + otlpGRPCPath
+	} else {
+		s.url = config.Endpoint + "/v1/logs"
+	}
+
+	return s, nil
+}
+
+func (s *OTLPSink) Name() string {
+	return "otlp " + s.config.Endpoint
+}
+
+func (s *OTLPSink) WriteBatch(records []Record) error {
+	body := s.exportRequest(records)
+
+	if s.config.Compression == "gzip" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write(body)
+		err := zw.Close()
+		if err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	return withRetries(s.config.MaxRetries, func() error {
+		if s.config.Protocol == "grpc" {
+			return s.exportGRPC(body)
+		}
+		return s.exportHTTP(body)
+	})
+}
+
+func (s *OTLPSink) Close() error {
+	return nil
+}
+
+func (s *OTLPSink) newRequest(body []byte) (*http.Request, error) {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s.config.Headers {
+		req.Header.Set(k, v)
+	}
+	return req, nil
+}
+
+func (s *OTLPSink) exportHTTP(body []byte) error {
+	req, err := s.newRequest(body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	if s.config.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := string(respBody)
+		if len(msg) > httpMaxErrorBody {
+			msg = msg[:httpMaxErrorBody]
+		}
+		return &HTTPStatusError{
+			StatusCode: resp.StatusCode,
+			Body:       msg,
+		}
+	}
+	return nil
+}
+
+func (s *OTLPSink) exportGRPC(body []byte) error {
+	// A gRPC message is prefixed with a compressed flag and its length.
+	frame := make([]byte, 5, 5+len(body))
+	if s.config.Compression == "gzip" {
+		frame[0] = 1
+	}
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(body)))
+	frame = append(frame, body...)
+
+	req, err := s.newRequest(frame)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if s.config.Compression == "gzip" {
+		req.Header.Set("Grpc-Encoding", "gzip")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// The status arrives in the trailers, which are only available
+	// once the body has been read.
+	ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return &HTTPStatusError{
+			StatusCode: resp.StatusCode,
+		}
+	}
+
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// A response without a body may carry its status in the
+		// headers instead.
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("invalid grpc status %q", status)
+	}
+	if code != 0 {
+		return &grpcStatusError{
+			code:    code,
+			message: message,
+		}
+	}
+	return nil
+}
+
+// exportRequest encodes an ExportLogsServiceRequest message holding the
+// given records, with a ResourceLogs for each distinct host and boot.
+func (s *OTLPSink) exportRequest(records []Record) []byte {
+	var resourceKeys []string
+	resources := map[string][]byte{}
+	logRecords := map[string][]byte{}
+	now := uint64(time.Now().UnixNano())
+
+	for i := range records {
+		record := &records[i]
+
+		var resourceAttrs, attrs []byte
+		resourceAttrs = otlpAppendAttribute(resourceAttrs, 1, "host.id", record.InstanceId)
+		record.VisitJournalFields(func(name string, value interface{}) {
+			switch name {
+			case "MESSAGE", "PRIORITY":
+				return
+			}
+			if key, ok := otlpResourceFields[name]; ok {
+				resourceAttrs = otlpAppendAttribute(resourceAttrs, 1, key, value)
+				return
+			}
+			attrs = otlpAppendAttribute(attrs, 6, name, value)
+		})
+
+		key := string(resourceAttrs)
+		if _, ok := resources[key]; !ok {
+			resourceKeys = append(resourceKeys, key)
+			resources[key] = resourceAttrs
+		}
+
+		// LogRecord
+		var msg []byte
+		msg = protoAppendFixed64Field(msg, 1, uint64(record.Time().UnixNano()))
+		msg = protoAppendVarintField(msg, 2, otlpSeverity[record.Priority])
+		msg = protoAppendStringField(msg, 3, strings.Trim(string(PriorityJSON[record.Priority]), `"`))
+		msg = protoAppendBytesField(msg, 5, otlpAnyValue(record.Message))
+		msg = append(msg, attrs...)
+		msg = protoAppendFixed64Field(msg, 11, now)
+
+		logRecords[key] = protoAppendBytesField(logRecords[key], 2, msg)
+	}
+
+	// InstrumentationScope
+	var scope []byte
+	scope = protoAppendStringField(scope, 1, "journald-cloudwatch-logs")
+
+	var body []byte
+	for _, key := range resourceKeys {
+		// ScopeLogs
+		var scopeLogs []byte
+		scopeLogs = protoAppendBytesField(scopeLogs, 1, scope)
+		scopeLogs = append(scopeLogs, logRecords[key]...)
+
+		// ResourceLogs
+		var resourceLogs []byte
+		resourceLogs = protoAppendBytesField(resourceLogs, 1, resources[key])
+		resourceLogs = protoAppendBytesField(resourceLogs, 2, scopeLogs)
+
+		body = protoAppendBytesField(body, 1, resourceLogs)
+	}
+	return body
+}
+
+// otlpAppendAttribute appends a KeyValue as the given field, unless the
+// value is empty.
+func otlpAppendAttribute(b []byte, field int, key string, value interface{}) []byte {
+	if value == "" {
+		return b
+	}
+	var kv []byte
+	kv = protoAppendStringField(kv, 1, key)
+	kv = protoAppendBytesField(kv, 2, otlpAnyValue(value))
+	return protoAppendBytesField(b, field, kv)
+}
+
+// otlpAnyValue encodes a string or int as an AnyValue message.
+func otlpAnyValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case int:
+		return protoAppendVarintField(nil, 3, uint64(v))
+	case string:
+		return protoAppendStringField(nil, 1, v)
+	}
+	return nil
+}
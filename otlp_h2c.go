@@ -0,0 +1,15 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import "net/http"
+
+// useHTTP2Only makes the transport speak only HTTP/2, as gRPC requires,
+// which for a plain http endpoint means HTTP/2 with prior knowledge.
+func useHTTP2Only(transport *http.Transport, unencrypted bool) error {
+	transport.Protocols = new(http.Protocols)
+	transport.Protocols.SetHTTP2(true)
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return nil
+}
@@ -0,0 +1,20 @@
+//go:build !go1.24
+// +build !go1.24
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// useHTTP2Only makes the transport speak HTTP/2, as gRPC requires. Before
+// Go 1.24, net/http can only negotiate it over TLS, so a plain http
+// endpoint can't be used.
+func useHTTP2Only(transport *http.Transport, unencrypted bool) error {
+	if unencrypted {
+		return fmt.Errorf("grpc with an http:// endpoint requires building with Go 1.24 or later; use an https:// endpoint or the http protocol")
+	}
+	transport.ForceAttemptHTTP2 = true
+	return nil
+}
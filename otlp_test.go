@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOTLPExportRequest(t *testing.T) {
+	records := []Record{
+		{
+			InstanceId:  "i-1",
+			Hostname:    "web-1",
+			PID:         42,
+			SystemdUnit: "cron.service",
+			Priority:    ERROR,
+			Message:     "first",
+			TimeUsec:    1700000000123,
+		},
+		{
+			InstanceId: "i-2",
+			Hostname:   "web-2",
+			Priority:   INFO,
+			Message:    "second",
+			TimeUsec:   1700000001000,
+		},
+		{
+			InstanceId: "i-1",
+			Hostname:   "web-1",
+			Priority:   DEBUG,
+			Message:    "third",
+			TimeUsec:   1700000002000,
+		},
+	}
+
+	request := mustProtoDecode(t, (&OTLPSink{}).exportRequest(records))
+	resourceLogs := protoFieldsNamed(request, 1)
+	if len(resourceLogs) != 2 {
+		t.Fatalf("got %d resources, want one for each host", len(resourceLogs))
+	}
+
+	var messages []string
+	for i, field := range resourceLogs {
+		rl := mustProtoDecode(t, field.bytes)
+
+		resource := mustProtoDecode(t, protoFieldsNamed(rl, 1)[0].bytes)
+		attrs := otlpAttributes(t, protoFieldsNamed(resource, 1))
+		wantHost := []string{"i-1", "i-2"}[i]
+		if attrs["host.id"] != wantHost {
+			t.Errorf("resource %d has host.id %q, want %q", i, attrs["host.id"], wantHost)
+		}
+		if attrs["host.name"] == "" {
+			t.Errorf("resource %d has no host.name", i)
+		}
+
+		scopeLogs := mustProtoDecode(t, protoFieldsNamed(rl, 2)[0].bytes)
+		scope := mustProtoDecode(t, protoFieldsNamed(scopeLogs, 1)[0].bytes)
+		if name := string(protoFieldsNamed(scope, 1)[0].bytes); name != "journald-cloudwatch-logs" {
+			t.Errorf("scope is %q", name)
+		}
+
+		for _, field := range protoFieldsNamed(scopeLogs, 2) {
+			logRecord := mustProtoDecode(t, field.bytes)
+			body := mustProtoDecode(t, protoFieldsNamed(logRecord, 5)[0].bytes)
+			message := string(protoFieldsNamed(body, 1)[0].bytes)
+			messages = append(messages, message)
+
+			var record *Record
+			for j := range records {
+				if records[j].Message == message {
+					record = &records[j]
+				}
+			}
+			if record == nil {
+				t.Fatalf("unexpected message %q", message)
+			}
+
+			if got := protoFieldsNamed(logRecord, 1)[0].varint; got != uint64(record.Time().UnixNano()) {
+				t.Errorf("%s: time is %d, want %d", message, got, record.Time().UnixNano())
+			}
+			if got := protoFieldsNamed(logRecord, 2)[0].varint; got != otlpSeverity[record.Priority] {
+				t.Errorf("%s: severity is %d, want %d", message, got, otlpSeverity[record.Priority])
+			}
+			if got := string(protoFieldsNamed(logRecord, 3)[0].bytes); got != strings.Trim(string(PriorityJSON[record.Priority]), `"`) {
+				t.Errorf("%s: severity text is %q", message, got)
+			}
+			if len(protoFieldsNamed(logRecord, 11)) != 1 {
+				t.Errorf("%s: no observed time", message)
+			}
+
+			attrs := otlpAttributes(t, protoFieldsNamed(logRecord, 6))
+			if record.PID != 0 && attrs["_PID"] != int64(record.PID) {
+				t.Errorf("%s: _PID is %v, want %d", message, attrs["_PID"], record.PID)
+			}
+			if record.SystemdUnit != "" && attrs["_SYSTEMD_UNIT"] != record.SystemdUnit {
+				t.Errorf("%s: _SYSTEMD_UNIT is %v", message, attrs["_SYSTEMD_UNIT"])
+			}
+			if _, ok := attrs["MESSAGE"]; ok {
+				t.Errorf("%s: MESSAGE is repeated as an attribute", message)
+			}
+		}
+	}
+
+	// Records are grouped by resource, keeping their order within it.
+	want := []string{"first", "third", "second"}
+	if len(messages) != len(want) {
+		t.Fatalf("got messages %q, want %q", messages, want)
+	}
+	for i := range want {
+		if messages[i] != want[i] {
+			t.Errorf("got messages %q, want %q", messages, want)
+			break
+		}
+	}
+}
+
+// otlpAttributes decodes KeyValue fields into their keys and values, which
+// are strings or int64s.
+func otlpAttributes(t *testing.T, fields []protoField) map[string]interface{} {
+	t.Helper()
+	attrs := map[string]interface{}{}
+	for _, field := range fields {
+		kv := mustProtoDecode(t, field.bytes)
+		key := string(protoFieldsNamed(kv, 1)[0].bytes)
+		value := mustProtoDecode(t, protoFieldsNamed(kv, 2)[0].bytes)
+		if len(value) != 1 {
+			t.Fatalf("attribute %s has %d values", key, len(value))
+		}
+		switch value[0].num {
+		case 1:
+			attrs[key] = string(value[0].bytes)
+		case 3:
+			attrs[key] = int64(value[0].varint)
+		default:
+			t.Fatalf("attribute %s has unexpected value field %d", key, value[0].num)
+		}
+	}
+	return attrs
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Pipeline delivers batches to a set of sinks concurrently.
+//
+// Each sink has its own lane: a queue that its batches are written from
+// one at a time and in order, so that ordering is preserved within each
+// destination stream while different destinations make progress
+// independently. The number of writes in flight across all lanes is
+// limited, and each lane can be limited to a number of writes per second.
+//
+// A batch is only committed once every lane has written it and every
+// earlier batch has been committed, so the committed journal position
+// never moves past an entry that some destination hasn't received.
+type Pipeline struct {
+	lanes   []*lane
+	slots   chan struct{}
+	commit  func(cursor string) error
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	pending []*pendingBatch
+	cursor  string
+	err     error
+}
+
+type lane struct {
+	sink     Sink
+	queue    chan *pendingBatch
+	interval time.Duration
+}
+
+type pendingBatch struct {
+	records   []Record
+	cursor    string
+	remaining int
+}
+
+// LaneConfig describes one of the sinks a pipeline writes to.
+type LaneConfig struct {
+	Sink Sink
+
+	// MaxRequestsPerSecond limits how often batches are written to the
+	// sink. Zero means no limit.
+	MaxRequestsPerSecond float64
+}
+
+// NewPipeline starts a lane for each of the given sinks. At most
+// maxConcurrent batches will be written at once, and at most maxPending
+// batches can wait in each lane before Submit blocks. commit is called,
+// in order, with the cursor of each batch once it has been written
+// everywhere; cursor is the position that was last committed before the
+// pipeline started.
+func NewPipeline(lanes []LaneConfig, maxConcurrent, maxPending int, cursor string, commit func(cursor string) error) *Pipeline {
+	p := &Pipeline{
+		slots:  make(chan struct{}, maxConcurrent),
+		commit: commit,
+		cursor: cursor,
+	}
+
+	var names []string
+	for _, config := range lanes {
+		names = append(names, config.Sink.Name())
+		l := &lane{
+			sink:  config.Sink,
+			queue: make(chan *pendingBatch, maxPending),
+		}
+		if config.MaxRequestsPerSecond > 0 {
+			l.interval = time.Duration(float64(time.Second) / config.MaxRequestsPerSecond)
+		}
+		p.lanes = append(p.lanes, l)
+
+		p.wg.Add(1)
+		go p.run(l)
+	}
+	pipelineActivity.setOutputs(names, maxPending)
+
+	return p
+}
+
+// Submit queues a batch to be written to every sink. The records are
+// copied, so the caller may reuse the slice once Submit returns. If an
+// earlier batch has failed then its error is returned instead.
+func (p *Pipeline) Submit(records []Record) error {
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return p.err
+	}
+
+	batch := &pendingBatch{
+		records:   append([]Record(nil), records...),
+		remaining: len(p.lanes),
+	}
+	prev := p.cursor
+	if len(p.pending) > 0 {
+		prev = p.pending[len(p.pending)-1].cursor
+	}
+	batch.cursor = lastCursor(records, prev)
+	p.pending = append(p.pending, batch)
+	pendingBatchesMetric.Set(float64(len(p.pending)))
+	pipelineActivity.setPending(p.pending)
+	p.mu.Unlock()
+
+	if len(p.lanes) == 0 {
+		p.done(batch)
+	}
+	for _, l := range p.lanes {
+		l.queue <- batch
+	}
+	return nil
+}
+
+// Close waits for every submitted batch to be written, or abandoned
+// after a failure, and returns the first error that occurred.
+func (p *Pipeline) Close() error {
+	for _, l := range p.lanes {
+		close(l.queue)
+	}
+	p.wg.Wait()
+	return p.err
+}
+
+// Cursor returns the cursor of the last committed batch.
+func (p *Pipeline) Cursor() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cursor
+}
+
+func (p *Pipeline) run(l *lane) {
+	defer p.wg.Done()
+
+	var last time.Time
+	for batch := range l.queue {
+		if p.failed() {
+			// Keep draining the queue so Submit can't block,
+			// but there's no point writing anything else.
+			continue
+		}
+
+		if l.interval > 0 {
+			if wait := l.interval - time.Since(last); wait > 0 {
+				time.Sleep(wait)
+			}
+			last = time.Now()
+		}
+
+		p.slots <- struct{}{}
+		finished := pipelineActivity.startWrite()
+		err := l.sink.WriteBatch(batch.records)
+		finished()
+		<-p.slots
+
+		if err != nil {
+			p.fail(fmt.Errorf("Failed to write to %s: %s", l.sink.Name(), err))
+			continue
+		}
+		pipelineActivity.delivered(l.sink.Name())
+		p.done(batch)
+	}
+}
+
+// done records that one lane has written the given batch, and commits
+// any batches at the head of the queue that are now fully written.
+func (p *Pipeline) done(batch *pendingBatch) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	batch.remaining--
+	for len(p.pending) > 0 && p.pending[0].remaining <= 0 {
+		head := p.pending[0]
+		p.pending = p.pending[1:]
+		if p.err != nil {
+			continue
+		}
+		err := p.commit(head.cursor)
+		if err != nil {
+			p.err = fmt.Errorf("Failed to write state: %s", err)
+			continue
+		}
+		p.cursor = head.cursor
+		observeAck(head.records)
+		pipelineActivity.acked(head.cursor, head.records)
+	}
+	pendingBatchesMetric.Set(float64(len(p.pending)))
+	pipelineActivity.setPending(p.pending)
+}
+
+func (p *Pipeline) fail(err error) {
+	pipelineActivity.failed(err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *Pipeline) failed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err != nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink is a sink whose writes each wait to be released with a result,
+// so that tests can complete them in whatever order they choose.
+type fakeSink struct {
+	name    string
+	results chan error
+
+	// started, if set, is called with 1 when a write starts and -1
+	// when it finishes.
+	started func(delta int)
+}
+
+func newFakeSink(name string) *fakeSink {
+	return &fakeSink{name: name, results: make(chan error)}
+}
+
+func (s *fakeSink) Name() string {
+	return s.name
+}
+
+func (s *fakeSink) WriteBatch(records []Record) error {
+	if s.started != nil {
+		s.started(1)
+		defer s.started(-1)
+	}
+	return <-s.results
+}
+
+func (s *fakeSink) Close() error {
+	return nil
+}
+
+// commitLog collects the cursors that a pipeline commits.
+type commitLog struct {
+	mu      sync.Mutex
+	cursors []string
+}
+
+func (c *commitLog) commit(cursor string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cursors = append(c.cursors, cursor)
+	return nil
+}
+
+func (c *commitLog) get() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.cursors...)
+}
+
+// waitFor waits until exactly the wanted cursors have been committed,
+// and then a little longer in case any others follow.
+func (c *commitLog) waitFor(t *testing.T, step string, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && len(c.get()) < len(want) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := c.get(); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("after %s, committed %q, want %q", step, got, want)
+	}
+}
+
+func batchWithCursor(cursor string) []Record {
+	return []Record{{Message: "entry " + cursor, Cursor: cursor}}
+}
+
+func TestPipelineOrderedCommit(t *testing.T) {
+	type release struct {
+		lane int
+		err  error
+	}
+	failure := errors.New("no")
+
+	tests := []struct {
+		name    string
+		lanes   int
+		batches int
+		// steps release the oldest unfinished write of a lane, and
+		// commits are the cursors committed once each has finished.
+		steps   []release
+		commits [][]string
+		err     string
+	}{
+		{
+			name:    "one lane in order",
+			lanes:   1,
+			batches: 2,
+			steps:   []release{{0, nil}, {0, nil}},
+			commits: [][]string{{"c1"}, {"c1", "c2"}},
+		},
+		{
+			name:    "a lane ahead of another",
+			lanes:   2,
+			batches: 3,
+			steps:   []release{{0, nil}, {0, nil}, {0, nil}, {1, nil}, {1, nil}, {1, nil}},
+			commits: [][]string{{}, {}, {}, {"c1"}, {"c1", "c2"}, {"c1", "c2", "c3"}},
+		},
+		{
+			name:    "lanes interleaved",
+			lanes:   2,
+			batches: 2,
+			steps:   []release{{1, nil}, {1, nil}, {0, nil}, {0, nil}},
+			commits: [][]string{{}, {}, {"c1"}, {"c1", "c2"}},
+		},
+		{
+			name:    "failure stops commits",
+			lanes:   2,
+			batches: 3,
+			steps:   []release{{0, nil}, {1, nil}, {1, nil}, {0, failure}, {1, nil}},
+			commits: [][]string{{}, {"c1"}, {"c1"}, {"c1"}, {"c1"}},
+			err:     "Failed to write to lane0: no",
+		},
+		{
+			name:    "failure of a lane behind",
+			lanes:   2,
+			batches: 2,
+			steps:   []release{{0, nil}, {0, nil}, {1, failure}},
+			commits: [][]string{{}, {}, {}},
+			err:     "Failed to write to lane1: no",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var configs []LaneConfig
+			var sinks []*fakeSink
+			for i := 0; i < test.lanes; i++ {
+				sink := newFakeSink(fmt.Sprintf("lane%d", i))
+				sinks = append(sinks, sink)
+				configs = append(configs, LaneConfig{Sink: sink})
+			}
+			commits := &commitLog{}
+			pipeline := NewPipeline(configs, test.lanes, test.batches, "c0", commits.commit)
+
+			for i := 1; i <= test.batches; i++ {
+				err := pipeline.Submit(batchWithCursor(fmt.Sprintf("c%d", i)))
+				if err != nil {
+					t.Fatalf("submitting batch %d: %s", i, err)
+				}
+			}
+
+			for i, step := range test.steps {
+				sinks[step.lane].results <- step.err
+				commits.waitFor(t, fmt.Sprintf("step %d", i+1), test.commits[i])
+			}
+
+			// A failed lane drains its queue without writing, while
+			// the others carry on with what they were given.
+			go func() {
+				for _, sink := range sinks {
+					for {
+						select {
+						case sink.results <- nil:
+							continue
+						case <-time.After(50 * time.Millisecond):
+						}
+						break
+					}
+				}
+			}()
+			err := pipeline.Close()
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			} else {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("got error %v, want %s", err, test.err)
+				}
+				if err := pipeline.Submit(batchWithCursor("later")); err == nil {
+					t.Errorf("submitted a batch after a failure")
+				}
+			}
+
+			want := test.commits[len(test.commits)-1]
+			if got := commits.get(); strings.Join(got, " ") != strings.Join(want, " ") {
+				t.Errorf("finally committed %q, want %q", got, want)
+			}
+			wantCursor := "c0"
+			if len(want) > 0 {
+				wantCursor = want[len(want)-1]
+			}
+			if cursor := pipeline.Cursor(); cursor != wantCursor {
+				t.Errorf("cursor is %s, want %s", cursor, wantCursor)
+			}
+		})
+	}
+}
+
+func TestPipelineConcurrencyLimit(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxActive int
+	var configs []LaneConfig
+	var sinks []*fakeSink
+	for _, name := range []string{"a", "b", "c"} {
+		sink := newFakeSink(name)
+		sink.started = func(delta int) {
+			mu.Lock()
+			defer mu.Unlock()
+			active += delta
+			if active > maxActive {
+				maxActive = active
+			}
+		}
+		sinks = append(sinks, sink)
+		configs = append(configs, LaneConfig{Sink: sink})
+	}
+	commits := &commitLog{}
+	pipeline := NewPipeline(configs, 1, 2, "", commits.commit)
+	for _, cursor := range []string{"c1", "c2"} {
+		if err := pipeline.Submit(batchWithCursor(cursor)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Release the writes one at a time, whichever lane has one going,
+	// giving the others time to start theirs if they wrongly could.
+	for i := 0; i < len(sinks)*2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		released := false
+		deadline := time.Now().Add(time.Second)
+		for !released && time.Now().Before(deadline) {
+			for _, sink := range sinks {
+				select {
+				case sink.results <- nil:
+					released = true
+				default:
+				}
+				if released {
+					break
+				}
+			}
+		}
+		if !released {
+			t.Fatalf("write %d never started", i+1)
+		}
+	}
+
+	if err := pipeline.Close(); err != nil {
+		t.Fatal(err)
+	}
+	commits.waitFor(t, "closing", []string{"c1", "c2"})
+	if maxActive != 1 {
+		t.Errorf("%d writes were in progress at once, want 1", maxActive)
+	}
+}
+
+func TestPipelineSyntheticBatch(t *testing.T) {
+	sink := newFakeSink("a")
+	commits := &commitLog{}
+	pipeline := NewPipeline([]LaneConfig{{Sink: sink}}, 1, 2, "c0", commits.commit)
+
+	// A batch of only synthetic records keeps the previous position.
+	pipeline.Submit([]Record{{Message: "synthetic"}})
+	pipeline.Submit(batchWithCursor("c1"))
+	sink.results <- nil
+	sink.results <- nil
+	if err := pipeline.Close(); err != nil {
+		t.Fatal(err)
+	}
+	commits.waitFor(t, "closing", []string{"c0", "c1"})
+}
+
+func TestLastCursor(t *testing.T) {
+	tests := []struct {
+		cursors  []string
+		fallback string
+		want     string
+	}{
+		{nil, "f", "f"},
+		{[]string{""}, "f", "f"},
+		{[]string{"a", "b"}, "f", "b"},
+		{[]string{"a", ""}, "f", "a"},
+		{[]string{"", "b", ""}, "", "b"},
+	}
+	for _, test := range tests {
+		var records []Record
+		for _, cursor := range test.cursors {
+			records = append(records, Record{Cursor: cursor})
+		}
+		if got := lastCursor(records, test.fallback); got != test.want {
+			t.Errorf("lastCursor(%q, %q) = %q, want %q", test.cursors, test.fallback, got, test.want)
+		}
+	}
+}
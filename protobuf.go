@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// The helpers in this file write the small subset of the protocol buffers
+// wire format needed to produce the payloads of the outputs that accept
+// protobuf. Messages are built inside out: an embedded message is encoded
+// into its own buffer first and then appended as a length-delimited field.
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+func protoAppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func protoAppendTag(b []byte, field int, wireType int) []byte {
+	return protoAppendVarint(b, uint64(field)<<3|uint64(wireType))
+}
+
+func protoAppendVarintField(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protoAppendTag(b, field, protoVarint)
+	return protoAppendVarint(b, v)
+}
+
+func protoAppendFixed64Field(b []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protoAppendTag(b, field, protoFixed64)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func protoAppendBytesField(b []byte, field int, v []byte) []byte {
+	b = protoAppendTag(b, field, protoBytes)
+	b = protoAppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func protoAppendStringField(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protoAppendTag(b, field, protoBytes)
+	b = protoAppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
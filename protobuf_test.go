@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// protoField is a field decoded from the protocol buffers wire format.
+type protoField struct {
+	num    int
+	wire   int
+	varint uint64
+	bytes  []byte
+}
+
+// protoDecode splits a message into its fields, independently of the
+// encoding helpers under test.
+func protoDecode(b []byte) ([]protoField, error) {
+	var fields []protoField
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("bad tag")
+		}
+		b = b[n:]
+		field := protoField{num: int(tag >> 3), wire: int(tag & 7)}
+		switch field.wire {
+		case protoVarint:
+			field.varint, n = binary.Uvarint(b)
+			if n <= 0 {
+				return nil, fmt.Errorf("bad varint in field %d", field.num)
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("short fixed64 in field %d", field.num)
+			}
+			field.varint = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case protoBytes:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return nil, fmt.Errorf("bad length in field %d", field.num)
+			}
+			field.bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		default:
+			return nil, fmt.Errorf("unexpected wire type %d in field %d", field.wire, field.num)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// mustProtoDecode decodes a message, failing the test if it's malformed.
+func mustProtoDecode(t *testing.T, b []byte) []protoField {
+	t.Helper()
+	fields, err := protoDecode(b)
+	if err != nil {
+		t.Fatalf("invalid message %x: %s", b, err)
+	}
+	return fields
+}
+
+// protoFieldsNamed returns the fields of a message with the given number.
+func protoFieldsNamed(fields []protoField, num int) []protoField {
+	var named []protoField
+	for _, field := range fields {
+		if field.num == num {
+			named = append(named, field)
+		}
+	}
+	return named
+}
+
+func TestProtoAppendVarint(t *testing.T) {
+	for _, v := range []uint64{0, 1, 127, 128, 300, 1<<32 - 1, 1 << 63, math.MaxUint64} {
+		b := protoAppendVarint(nil, v)
+		got, n := binary.Uvarint(b)
+		if n != len(b) || got != v {
+			t.Errorf("%d encoded as %x, which decodes as %d", v, b, got)
+		}
+	}
+}
+
+func TestProtoFields(t *testing.T) {
+	var b []byte
+	b = protoAppendVarintField(b, 1, 150)
+	b = protoAppendVarintField(b, 2, 0)
+	b = protoAppendFixed64Field(b, 3, 1e18)
+	b = protoAppendFixed64Field(b, 4, 0)
+	b = protoAppendStringField(b, 5, "testing")
+	b = protoAppendStringField(b, 6, "")
+	b = protoAppendBytesField(b, 7, nil)
+	b = protoAppendBytesField(b, 2000, []byte{1, 2, 3})
+
+	want := []protoField{
+		{num: 1, wire: protoVarint, varint: 150},
+		{num: 3, wire: protoFixed64, varint: 1e18},
+		{num: 5, wire: protoBytes, bytes: []byte("testing")},
+		{num: 7, wire: protoBytes, bytes: []byte{}},
+		{num: 2000, wire: protoBytes, bytes: []byte{1, 2, 3}},
+	}
+	got := mustProtoDecode(t, b)
+	if len(got) != len(want) {
+		t.Fatalf("got %d fields, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].num != want[i].num || got[i].wire != want[i].wire || got[i].varint != want[i].varint || string(got[i].bytes) != string(want[i].bytes) {
+			t.Errorf("field %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestLokiProtobufBody(t *testing.T) {
+	streams := []*lokiStream{
+		{
+			key: `{unit="cron.service"}`,
+			entries: []lokiEntry{
+				{timestampNano: 1700000000123456789, line: "first"},
+				{timestampNano: 1700000001000000000, line: "second"},
+			},
+		},
+		{
+			key: `{unit="sshd.service"}`,
+			entries: []lokiEntry{
+				{timestampNano: 1700000002000000001, line: "third"},
+			},
+		},
+	}
+
+	pushRequest := mustProtoDecode(t, lokiProtobufBody(streams))
+	if len(pushRequest) != len(streams) {
+		t.Fatalf("got %d streams, want %d", len(pushRequest), len(streams))
+	}
+	for i, field := range pushRequest {
+		stream := mustProtoDecode(t, field.bytes)
+		labels := protoFieldsNamed(stream, 1)
+		if len(labels) != 1 || string(labels[0].bytes) != streams[i].key {
+			t.Errorf("stream %d has labels %+v, want %s", i, labels, streams[i].key)
+		}
+
+		entries := protoFieldsNamed(stream, 2)
+		if len(entries) != len(streams[i].entries) {
+			t.Fatalf("stream %d has %d entries, want %d", i, len(entries), len(streams[i].entries))
+		}
+		for j, field := range entries {
+			want := streams[i].entries[j]
+			entry := mustProtoDecode(t, field.bytes)
+			ts := mustProtoDecode(t, protoFieldsNamed(entry, 1)[0].bytes)
+			var seconds, nanos uint64
+			for _, f := range ts {
+				switch f.num {
+				case 1:
+					seconds = f.varint
+				case 2:
+					nanos = f.varint
+				}
+			}
+			if got := int64(seconds)*1e9 + int64(nanos); got != want.timestampNano {
+				t.Errorf("entry %d/%d has time %d, want %d", i, j, got, want.timestampNano)
+			}
+			if line := string(protoFieldsNamed(entry, 2)[0].bytes); line != want.line {
+				t.Errorf("entry %d/%d has line %q, want %q", i, j, line, want.line)
+			}
+		}
+	}
+}
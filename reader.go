@@ -7,8 +7,17 @@ import (
 	"github.com/coreos/go-systemd/sdjournal"
 )
 
-func ReadRecords(instanceId string, journal *sdjournal.Journal, c chan<- Record, skip uint64) {
+// ReadRecords reads records from the journal into c, skipping the first
+// skip of them. If follow is set it then waits for new entries, otherwise
+// it closes c once it reaches the end of the journal. When a new config is
+// received, its log filters and instance id apply from the next record
+// read.
+func ReadRecords(config *Config, journal *sdjournal.Journal, c chan<- Record, skip uint64, follow bool, configs <-chan *Config) {
 	record := &Record{}
+	sent := false
+	instanceId := config.InstanceId
+	logPriority := config.LogPriority
+	includeCursor := config.IncludeCursor
 
 	termC := MakeTerminateChannel()
 	checkTerminate := func() bool {
@@ -16,6 +25,15 @@ func ReadRecords(instanceId string, journal *sdjournal.Journal, c chan<- Record,
 		case <-termC:
 			close(c)
 			return true
+		case config := <-configs:
+			// The journal keeps its position when its matches
+			// change, so reading continues from the same place.
+			journal.FlushMatches()
+			addReaderLogFilters(journal, config)
+			instanceId = config.InstanceId
+			logPriority = config.LogPriority
+			includeCursor = config.IncludeCursor
+			return false
 		default:
 			return false
 		}
@@ -25,30 +43,46 @@ func ReadRecords(instanceId string, journal *sdjournal.Journal, c chan<- Record,
 		if checkTerminate() {
 			return
 		}
+		pipelineActivity.read()
 		err := UnmarshalRecord(journal, record)
 		if err != nil {
 			c <- synthRecord(
 				fmt.Errorf("error unmarshalling record: %s", err),
 			)
+			sent = true
 			continue
 		}
 
+		recordsReadMetric.Add(1, record.SystemdUnit)
+
 		if skip > 0 {
 			skip--
+		} else if record.Priority > logPriority {
+			// Unless metrics are served, the journal's matches
+			// (see addReaderLogFilters) exclude these already.
+			recordsFilteredMetric.Add(1, record.SystemdUnit)
 		} else {
 			record.InstanceId = instanceId
+			record.Cursor, _ = journal.GetCursor()
+			record.JournalCursor = ""
+			if includeCursor {
+				record.JournalCursor = record.Cursor
+			}
 			c <- *record
+			sent = true
 		}
 
 		for {
 			if checkTerminate() {
 				return
 			}
+			pipelineActivity.read()
 			seeked, err := journal.Next()
 			if err != nil {
 				c <- synthRecord(
 					fmt.Errorf("error reading from journal: %s", err),
 				)
+				sent = true
 				// It's likely that we didn't actually advance here, so
 				// we should wait a bit so we don't spin the CPU at 100%
 				// when we run into errors.
@@ -56,6 +90,16 @@ func ReadRecords(instanceId string, journal *sdjournal.Journal, c chan<- Record,
 				continue
 			}
 			if seeked == 0 {
+				pipelineActivity.setCaughtUp(true)
+				if !sent {
+					// Otherwise the service is ready once
+					// what was sent has been delivered.
+					pipelineActivity.nothingToDeliver()
+				}
+				if !follow {
+					close(c)
+					return
+				}
 				// If there's nothing new in the stream then we'll
 				// wait for something new to show up.
 				// FIXME: We can actually end up waiting up to 2 seconds
@@ -65,6 +109,7 @@ func ReadRecords(instanceId string, journal *sdjournal.Journal, c chan<- Record,
 				journal.Wait(2 * time.Second)
 				continue
 			}
+			pipelineActivity.setCaughtUp(false)
 			break
 		}
 	}
@@ -94,6 +139,10 @@ func BatchRecords(records <-chan Record, batches chan<- []Record, batchSize int)
 		select {
 		case record, more = <-records:
 			if !more {
+				if next > 0 {
+					batchSizeMetric.Observe(float64(next))
+					batches <- bufs[currentBuf][0:next]
+				}
 				close(batches)
 				return
 			}
@@ -121,6 +170,7 @@ func BatchRecords(records <-chan Record, batches chan<- []Record, batchSize int)
 		// If we manage to fall out here then either the buffer is fuull
 		// or the batch timer expired. Either way it's time for us to
 		// emit a batch.
+		batchSizeMetric.Observe(float64(next))
 		batches <- bufs[currentBuf][0:next]
 
 		// Switch buffers before we start building the next batch.
@@ -131,11 +181,25 @@ func BatchRecords(records <-chan Record, batches chan<- []Record, batchSize int)
 
 // synthRecord produces synthetic records to report errors, so that
 // we can stream our own errors directly into cloudwatch rather than
-// emitting them through journald and risking feedback loops.
+// emitting them through journald and risking feedback loops. The error is
+// also kept for the status API.
 func synthRecord(err error) Record {
+	pipelineActivity.failed(err)
 	return Record{
 		Command:  "journald-cloudwatch-logs",
 		Priority: ERROR,
 		Message:  err.Error(),
+		TimeUsec: time.Now().Unix() * 1000,
+	}
+}
+
+// noticeRecord produces a synthetic record reporting something other than
+// an error, such as a change of configuration.
+func noticeRecord(message string) Record {
+	return Record{
+		Command:  "journald-cloudwatch-logs",
+		Priority: NOTICE,
+		Message:  message,
+		TimeUsec: time.Now().Unix() * 1000,
 	}
 }
@@ -1,5 +1,12 @@
 package main
 
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"time"
+)
+
 type Priority int
 
 var (
@@ -27,6 +34,7 @@ var PriorityJSON = map[Priority][]byte{
 type Record struct {
 	InstanceId     string       `json:"instanceId,omitempty"`
 	TimeUsec       int64        `json:"-"`
+	Cursor         string       `json:"-"`
 	PID            int          `json:"pid" journald:"_PID"`
 	UID            int          `json:"uid" journald:"_UID"`
 	GID            int          `json:"gid" journald:"_GID"`
@@ -41,12 +49,16 @@ type Record struct {
 	Priority       Priority     `json:"priority" journald:"PRIORITY"`
 	Message        string       `json:"message" journald:"MESSAGE"`
 	MessageId      string       `json:"messageId,omitempty" journald:"MESSAGE_ID"`
-	Errno          int          `json:"machineId,omitempty" journald:"ERRNO"`
+	Errno          int          `json:"errno,omitempty" journald:"ERRNO"`
 	Syslog         RecordSyslog `json:"syslog,omitempty"`
 	Kernel         RecordKernel `json:"kernel,omitempty"`
 	Container_Name string       `json:"containerName,omitempty" journald:"CONTAINER_NAME"`
 	Container_Tag  string       `json:"containerTag,omitempty" journald:"CONTAINER_TAG"`
 	Container_ID   string       `json:"containerID,omitempty" journald:"CONTAINER_ID"`
+
+	// JournalCursor is the same as Cursor, but is only set when the
+	// cursor is to be included in the event.
+	JournalCursor string `json:"cursor,omitempty"`
 }
 
 type RecordSyslog struct {
@@ -65,3 +77,53 @@ type RecordKernel struct {
 func (p Priority) MarshalJSON() ([]byte, error) {
 	return PriorityJSON[p], nil
 }
+
+func (p *Priority) UnmarshalJSON(data []byte) error {
+	for priority, name := range PriorityJSON {
+		if bytes.Equal(data, name) {
+			*p = priority
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not a priority", data)
+}
+
+// Time returns the time the record was logged. TimeUsec is, despite its
+// name, in milliseconds since the epoch, as Cloudwatch expects.
+func (r *Record) Time() time.Time {
+	return time.Unix(0, r.TimeUsec*int64(time.Millisecond))
+}
+
+// VisitJournalFields calls fn with the journal field name and value of
+// each non-empty field of the record that was read from the journal.
+// Values are either strings or ints.
+func (r *Record) VisitJournalFields(fn func(name string, value interface{})) {
+	visitJournalFields(reflect.ValueOf(r).Elem(), fn)
+}
+
+func visitJournalFields(val reflect.Value, fn func(name string, value interface{})) {
+	typ := val.Type()
+	for i := 0; i < val.NumField(); i++ {
+		fieldVal := val.Field(i)
+		if fieldVal.Kind() == reflect.Struct {
+			visitJournalFields(fieldVal, fn)
+			continue
+		}
+
+		jdKey := typ.Field(i).Tag.Get("journald")
+		if jdKey == "" {
+			continue
+		}
+
+		switch fieldVal.Kind() {
+		case reflect.Int:
+			if fieldVal.Int() != 0 {
+				fn(jdKey, int(fieldVal.Int()))
+			}
+		case reflect.String:
+			if fieldVal.String() != "" {
+				fn(jdKey, fieldVal.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/coreos/go-systemd/sdjournal"
+)
+
+// resumeMode says where reading the journal resumes from.
+type resumeMode int
+
+const (
+	// resumeAfterCursor resumes with the entry after the one we last
+	// delivered.
+	resumeAfterCursor resumeMode = iota
+
+	// resumeAtTail skips everything already in the journal.
+	resumeAtTail
+
+	// resumeAtHead starts with the first entry in the journal.
+	resumeAtHead
+)
+
+// seekResume positions the journal where reading should resume, given
+// the boot id and cursor that were saved last time. It returns the boot id
+// to save from now on, along with where the journal has been positioned.
+// Unless it's resumeAtHead, the journal is positioned on an entry that has
+// already been delivered, which must be skipped.
+func seekResume(journal *sdjournal.Journal, lastBootId, cursor string) (string, resumeMode, error) {
+	seeked, err := journal.Next()
+	if seeked == 0 || err != nil {
+		return "", 0, fmt.Errorf("unable to seek to first item in journal")
+	}
+
+	bootId, err := journal.GetData("_BOOT_ID")
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to read the boot id: %s", err)
+	}
+	bootId = bootId[9:] // Trim off "_BOOT_ID=" prefix
+
+	// If we saved the cursor of the last entry we delivered then we can
+	// resume immediately after it. Otherwise, if the boot id has changed
+	// since our last run then we'll start from the beginning of the
+	// stream, but if we're starting up with the same boot id then we'll
+	// seek to the end of the stream to avoid repeating anything. However,
+	// we will miss any items that were added while we weren't running.
+	if cursor != "" && seekCursor(journal, cursor) {
+		// The journal is now positioned on the entry we last
+		// delivered.
+		return bootId, resumeAfterCursor, nil
+	} else if bootId == lastBootId {
+		// If we're still in the same "boot" as we were last time then
+		// we were stopped and started again, so we'll seek to the last
+		// item in the log as an approximation of resuming streaming,
+		// though we will miss any logs that were added while we were
+		// running.
+		// Seeking only moves the journal between entries, so step
+		// back onto the last one.
+		journal.SeekTail()
+		journal.Previous()
+		return bootId, resumeAtTail, nil
+	} else if cursor != "" {
+		// Our saved cursor has been vacuumed out of the journal, and
+		// looking for it moved us away from the head.
+		journal.SeekHead()
+		journal.Next()
+	}
+	return bootId, resumeAtHead, nil
+}
+
+// seekCursor positions the journal on the entry with the given cursor,
+// returning false if that entry is no longer in the journal.
+func seekCursor(journal *sdjournal.Journal, cursor string) bool {
+	err := journal.SeekCursor(cursor)
+	if err != nil {
+		return false
+	}
+	seeked, err := journal.Next()
+	if seeked == 0 || err != nil {
+		return false
+	}
+	return journal.TestCursor(cursor) == nil
+}
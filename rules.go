@@ -0,0 +1,430 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxHistogramSamples limits the values a histogram keeps in each
+// interval to work out its percentiles from. Beyond that, a random sample
+// of the values is kept.
+const maxHistogramSamples = 10000
+
+// metricDimensions maps the names of the dimensions a rule can have to the
+// names they're given in Cloudwatch.
+var metricDimensions = map[string]string{
+	"unit":        "SystemdUnit",
+	"priority":    "Priority",
+	"instance_id": "InstanceId",
+	"log_stream":  "LogStream",
+}
+
+// MetricRulesConfig describes the metrics derived from the records, which
+// are published in Embedded Metric Format.
+type MetricRulesConfig struct {
+	EMFOutputConfig
+	Rules []*MetricRule
+}
+
+// MetricRule matches records and turns them into a metric. A record
+// matches if it matches every one of the rule's conditions that is set.
+type MetricRule struct {
+	Name string
+
+	// Units are glob patterns matched against the record's systemd
+	// unit.
+	Units []string
+
+	// Priority matches records of this priority or a more important
+	// one, if HasPriority is set.
+	Priority    Priority
+	HasPriority bool
+
+	Message *regexp.Regexp
+
+	// ValueGroup is the group of Message that holds the value to count
+	// or observe. If it's 0, each record counts as 1.
+	ValueGroup int
+
+	// Histogram is set if the values are observed rather than summed.
+	Histogram bool
+
+	MetricUnit string
+	Dimensions []string
+}
+
+type metricRulesConfig struct {
+	emfOutputConfig `hcl:",squash"`
+	Rules           map[string]*metricRuleConfig `hcl:"rule"`
+}
+
+type metricRuleConfig struct {
+	Units      []string `hcl:"units"`
+	Priority   string   `hcl:"priority"`
+	Message    string   `hcl:"message"`
+	ValueGroup int      `hcl:"value_group"`
+	Type       string   `hcl:"type"`
+	MetricUnit string   `hcl:"metric_unit"`
+	Dimensions []string `hcl:"dimensions"`
+}
+
+func loadMetricRulesConfig(fConfig *metricRulesConfig, logGroupName, logStreamName string) (*MetricRulesConfig, error) {
+	output, err := fConfig.emfOutputConfig.resolve(logGroupName, logStreamName, "-rules")
+	if err != nil {
+		return nil, err
+	}
+	config := &MetricRulesConfig{EMFOutputConfig: *output}
+
+	names := make([]string, 0, len(fConfig.Rules))
+	for name := range fConfig.Rules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rule, err := loadMetricRule(name, fConfig.Rules[name])
+		if err != nil {
+			return nil, fmt.Errorf("rule %q: %s", name, err)
+		}
+		config.Rules = append(config.Rules, rule)
+	}
+	if len(config.Rules) == 0 {
+		return nil, fmt.Errorf("at least one rule is required")
+	}
+	return config, nil
+}
+
+func loadMetricRule(name string, fConfig *metricRuleConfig) (*MetricRule, error) {
+	rule := &MetricRule{
+		Name:       name,
+		Units:      fConfig.Units,
+		ValueGroup: fConfig.ValueGroup,
+		MetricUnit: fConfig.MetricUnit,
+		Dimensions: fConfig.Dimensions,
+	}
+
+	for _, unit := range rule.Units {
+		if _, err := path.Match(unit, ""); err != nil {
+			return nil, fmt.Errorf("invalid unit pattern %q", unit)
+		}
+	}
+
+	if fConfig.Priority != "" {
+		priority, err := getLogLevel(fConfig.Priority)
+		if err != nil {
+			return nil, err
+		}
+		rule.Priority = priority
+		rule.HasPriority = true
+	}
+
+	if fConfig.Message != "" {
+		var err error
+		rule.Message, err = regexp.Compile(fConfig.Message)
+		if err != nil {
+			return nil, fmt.Errorf("invalid message: %s", err)
+		}
+	}
+
+	if rule.ValueGroup < 0 {
+		return nil, fmt.Errorf("value_group must not be negative")
+	} else if rule.ValueGroup > 0 && (rule.Message == nil || rule.ValueGroup > rule.Message.NumSubexp()) {
+		return nil, fmt.Errorf("value_group must be one of the groups in message")
+	}
+
+	switch fConfig.Type {
+	case "", "counter":
+	case "histogram":
+		if rule.ValueGroup == 0 {
+			return nil, fmt.Errorf("a histogram requires value_group")
+		}
+		rule.Histogram = true
+	default:
+		return nil, fmt.Errorf("type must be counter or histogram")
+	}
+
+	if rule.MetricUnit == "" {
+		if rule.Histogram {
+			rule.MetricUnit = "None"
+		} else {
+			rule.MetricUnit = "Count"
+		}
+	}
+
+	if rule.Dimensions == nil {
+		rule.Dimensions = []string{"instance_id"}
+	}
+	for _, dimension := range rule.Dimensions {
+		if metricDimensions[dimension] == "" {
+			return nil, fmt.Errorf("'%s' is not a supported dimension", dimension)
+		}
+	}
+
+	return rule, nil
+}
+
+// match returns whether the record matches the rule, and the value it
+// contributes.
+func (r *MetricRule) match(record *Record) (float64, bool) {
+	if len(r.Units) > 0 {
+		matched := false
+		for _, unit := range r.Units {
+			if ok, _ := path.Match(unit, record.SystemdUnit); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return 0, false
+		}
+	}
+
+	if r.HasPriority && record.Priority > r.Priority {
+		return 0, false
+	}
+
+	if r.Message == nil {
+		return 1, true
+	}
+	match := r.Message.FindStringSubmatch(record.Message)
+	if match == nil {
+		return 0, false
+	}
+	if r.ValueGroup == 0 {
+		return 1, true
+	}
+	value, err := strconv.ParseFloat(match[r.ValueGroup], 64)
+	if err != nil {
+		return 0, false
+	}
+	return value, true
+}
+
+// MetricRulesSink aggregates the metrics described by the rules over each
+// interval, and then writes them to Cloudwatch Logs in Embedded Metric
+// Format. The aggregates are only held in memory, so the current
+// interval's are lost if the program is killed, though they're written
+// when the sink is closed.
+type MetricRulesSink struct {
+	config     *MetricRulesConfig
+	writer     *Writer
+	dimensions map[string]string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// metricSeries is the aggregate of one rule, for one combination of its
+// dimensions' values.
+type metricSeries struct {
+	rule       *MetricRule
+	dimensions map[string]string
+
+	count    uint64
+	sum      float64
+	min, max float64
+	samples  []float64
+}
+
+func NewMetricRulesSink(config *Config) (*MetricRulesSink, error) {
+	writer, err := config.NewEMFWriter(&config.MetricRules.EMFOutputConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MetricRulesSink{
+		config: config.MetricRules,
+		writer: writer,
+		dimensions: map[string]string{
+			"instance_id": config.InstanceId,
+			"log_stream":  config.LogStreamName,
+		},
+		series: map[string]*metricSeries{},
+		done:   make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+func (s *MetricRulesSink) Name() string {
+	return "metric rules"
+}
+
+func (s *MetricRulesSink) WriteBatch(records []Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range records {
+		record := &records[i]
+		if record.Cursor == "" {
+			// Synthetic records report on the program itself, rather
+			// than coming from the journal.
+			continue
+		}
+		for _, rule := range s.config.Rules {
+			value, ok := rule.match(record)
+			if !ok {
+				continue
+			}
+			s.observe(rule, record, value)
+		}
+	}
+	return nil
+}
+
+func (s *MetricRulesSink) observe(rule *MetricRule, record *Record, value float64) {
+	dimensions := map[string]string{}
+	key := []string{rule.Name}
+	for _, name := range rule.Dimensions {
+		var dimension string
+		switch name {
+		case "unit":
+			dimension = record.SystemdUnit
+		case "priority":
+			dimension = strings.Trim(string(PriorityJSON[record.Priority]), `"`)
+		default:
+			dimension = s.dimensions[name]
+		}
+		if dimension == "" {
+			// Cloudwatch doesn't accept empty dimension values.
+			dimension = "none"
+		}
+		dimensions[metricDimensions[name]] = dimension
+		key = append(key, dimension)
+	}
+
+	seriesKey := strings.Join(key, "\x00")
+	series, ok := s.series[seriesKey]
+	if !ok {
+		series = &metricSeries{
+			rule:       rule,
+			dimensions: dimensions,
+			min:        math.Inf(1),
+			max:        math.Inf(-1),
+		}
+		s.series[seriesKey] = series
+	}
+
+	series.count++
+	series.sum += value
+	if !rule.Histogram {
+		return
+	}
+	series.min = math.Min(series.min, value)
+	series.max = math.Max(series.max, value)
+	if len(series.samples) < maxHistogramSamples {
+		series.samples = append(series.samples, value)
+	} else if i := rand.Int63n(int64(series.count)); i < maxHistogramSamples {
+		series.samples[i] = value
+	}
+}
+
+func (s *MetricRulesSink) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.flush()
+		}
+	}
+}
+
+// flush writes the metrics aggregated since the last flush.
+func (s *MetricRulesSink) flush() {
+	s.mu.Lock()
+	series := s.series
+	s.series = map[string]*metricSeries{}
+	s.mu.Unlock()
+
+	if len(series) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	var events []Record
+	for _, key := range keys {
+		event, err := EncodeEMF(s.config.Namespace, series[key].dimensions, series[key].metrics(), now)
+		if err != nil {
+			s.failed(err)
+			return
+		}
+		events = append(events, Record{
+			Message:  string(event),
+			TimeUsec: now.UnixNano() / int64(time.Millisecond),
+		})
+	}
+
+	for len(events) > 0 {
+		n := len(events)
+		if n > maxBatchEvents {
+			n = maxBatchEvents
+		}
+		err := s.writer.WriteBatch(events[:n])
+		if err != nil {
+			s.failed(err)
+			return
+		}
+		events = events[n:]
+	}
+}
+
+func (s *MetricRulesSink) failed(err error) {
+	err = fmt.Errorf("Failed to publish rule metrics: %s", err)
+	log.Print(err)
+	pipelineActivity.failed(err)
+}
+
+// metrics returns the series' metrics. A counter is a single metric, while
+// a histogram is summarized by its count, sum, extremes and percentiles.
+func (m *metricSeries) metrics() []EMFMetric {
+	name, unit := m.rule.Name, m.rule.MetricUnit
+	if !m.rule.Histogram {
+		return []EMFMetric{{name, unit, m.sum}}
+	}
+
+	sort.Float64s(m.samples)
+	percentile := func(p float64) float64 {
+		return m.samples[int(math.Ceil(p*float64(len(m.samples))))-1]
+	}
+	return []EMFMetric{
+		{name + "_count", "Count", m.count},
+		{name + "_sum", unit, m.sum},
+		{name + "_min", unit, m.min},
+		{name + "_max", unit, m.max},
+		{name + "_p50", unit, percentile(0.5)},
+		{name + "_p90", unit, percentile(0.9)},
+		{name + "_p99", unit, percentile(0.99)},
+	}
+}
+
+// Close writes the metrics aggregated so far.
+func (s *MetricRulesSink) Close() error {
+	close(s.done)
+	s.wg.Wait()
+	s.flush()
+	return nil
+}
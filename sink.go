@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Sink is an output that batches of journal records are delivered to.
+//
+// The main loop only commits the journal position to the state file
+// once every configured sink has accepted a batch, so a sink must not
+// return from WriteBatch until the records are durably handed off.
+type Sink interface {
+	// Name identifies the sink in error messages.
+	Name() string
+
+	// WriteBatch delivers the given records. The slice is only valid
+	// until WriteBatch returns.
+	WriteBatch(records []Record) error
+
+	Close() error
+}
+
+// OpenSinks creates the outputs, other than Cloudwatch Logs, that are
+// enabled in the given configuration.
+func OpenSinks(config *Config) ([]Sink, error) {
+	var sinks []Sink
+	fail := func(err error) ([]Sink, error) {
+		for _, sink := range sinks {
+			sink.Close()
+		}
+		return nil, err
+	}
+
+	if config.MetricRules != nil {
+		sink, err := NewMetricRulesSink(config)
+		if err != nil {
+			return fail(fmt.Errorf("error initializing metric rules: %s", err))
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if config.FileSink != nil {
+		sink, err := NewFileSink(config.FileSink)
+		if err != nil {
+			return fail(fmt.Errorf("error opening %s: %s", config.FileSink.Path, err))
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if config.SyslogSink != nil {
+		sink, err := NewSyslogSink(config.SyslogSink)
+		if err != nil {
+			return fail(fmt.Errorf("error initializing syslog: %s", err))
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if config.LokiSink != nil {
+		sink, err := NewLokiSink(config.LokiSink)
+		if err != nil {
+			return fail(fmt.Errorf("error initializing loki: %s", err))
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if config.ESSink != nil {
+		sink, err := NewElasticsearchSink(config.ESSink, config.AWSCredentials)
+		if err != nil {
+			return fail(fmt.Errorf("error initializing elasticsearch: %s", err))
+		}
+		sinks = append(sinks, sink)
+	}
+
+	if config.OTLPSink != nil {
+		sink, err := NewOTLPSink(config.OTLPSink)
+		if err != nil {
+			return fail(fmt.Errorf("error initializing otlp: %s", err))
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return sinks, nil
+}
+
+// lastCursor returns the journal cursor of the newest entry in the given
+// batch, or the given fallback if the batch holds only synthetic records.
+func lastCursor(records []Record, fallback string) string {
+	for i := len(records) - 1; i >= 0; i-- {
+		if records[i].Cursor != "" {
+			return records[i].Cursor
+		}
+	}
+	return fallback
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/binary"
+)
+
+// snappyEncode compresses src using the snappy block format, as expected
+// by the Loki push API. It's a straightforward greedy implementation that
+// trades some compression ratio for simplicity; any conforming decoder
+// can read its output.
+func snappyEncode(src []byte) []byte {
+	dst := protoAppendVarint(nil, uint64(len(src)))
+
+	// Like the reference implementation we compress in independent
+	// 64KiB blocks, which keeps every copy offset within two bytes.
+	for len(src) > 0 {
+		block := src
+		if len(block) > 1<<16 {
+			block = block[:1<<16]
+		}
+		src = src[len(block):]
+		dst = snappyEncodeBlock(dst, block)
+	}
+	return dst
+}
+
+func snappyEncodeBlock(dst, src []byte) []byte {
+	const tableBits = 14
+	// Positions are stored off by one so that zero means "empty".
+	var table [1 << tableBits]int32
+
+	hash := func(u uint32) uint32 {
+		return (u * 0x1e35a7bd) >> (32 - tableBits)
+	}
+
+	literalStart := 0
+	i := 0
+	for i+4 <= len(src) {
+		cur := binary.LittleEndian.Uint32(src[i:])
+		h := hash(cur)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != cur {
+			i++
+			continue
+		}
+
+		length := 4
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+
+		dst = snappyEmitLiteral(dst, src[literalStart:i])
+		dst = snappyEmitCopy(dst, i-candidate, length)
+		i += length
+		literalStart = i
+	}
+
+	return snappyEmitLiteral(dst, src[literalStart:])
+}
+
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyEmitCopy emits copies with two byte offsets, each of which can
+// cover at most 64 bytes, splitting longer matches so that every piece
+// is at least four bytes long.
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+}
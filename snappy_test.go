@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// snappyDecode decodes the snappy block format, following the format
+// description rather than the encoder under test.
+func snappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 {
+		return nil, fmt.Errorf("bad length")
+	}
+	src = src[n:]
+
+	var dst []byte
+	for len(src) > 0 {
+		tag := src[0]
+		var offset, length int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, fmt.Errorf("short literal length")
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[i])
+				}
+				src = src[extra:]
+			}
+			length++
+			if len(src) < length {
+				return nil, fmt.Errorf("short literal")
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, fmt.Errorf("short copy")
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag>>5)<<8 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, fmt.Errorf("short copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, fmt.Errorf("short copy")
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) {
+			return nil, fmt.Errorf("copy offset %d out of range at %d", offset, len(dst))
+		}
+		// Copies may overlap their own output.
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+
+	if uint64(len(dst)) != length {
+		return nil, fmt.Errorf("decoded %d bytes, want %d", len(dst), length)
+	}
+	return dst, nil
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	random := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("abc")},
+		{"literal of 60", random[:60]},
+		{"literal of 61", random[:61]},
+		{"literal of 300", random[:300]},
+		{"repeated byte", bytes.Repeat([]byte{'a'}, 1000)},
+		{"period 4", []byte("0123" + strings.Repeat("abcd", 16) + "0123")},
+		{"period 5", []byte("abcde" + strings.Repeat("abcde", 13) + "z")},
+		{"period 7", []byte(strings.Repeat("abcdefg", 11) + "z")},
+		{"long copy", []byte(strings.Repeat("abcd", 18) + "z")},
+		{"text", []byte(strings.Repeat("pam_unix(cron:session): session opened for user root by (uid=0)\n", 500))},
+		{"random", random},
+		{"mixed blocks", append(append([]byte(nil), random[:70000]...), bytes.Repeat([]byte("journal "), 20000)...)},
+	}
+
+	for _, test := range tests {
+		encoded := snappyEncode(test.data)
+		decoded, err := snappyDecode(encoded)
+		if err != nil {
+			t.Errorf("%s: can't decode: %s", test.name, err)
+			continue
+		}
+		if !bytes.Equal(decoded, test.data) {
+			t.Errorf("%s: decoded %d bytes differ from the %d encoded", test.name, len(decoded), len(test.data))
+		}
+	}
+}
+
+func TestSnappyCompresses(t *testing.T) {
+	data := []byte(strings.Repeat("pam_unix(cron:session): session opened for user root by (uid=0)\n", 500))
+	if encoded := snappyEncode(data); len(encoded) > len(data)/10 {
+		t.Errorf("repetitive text of %d bytes compressed to %d", len(data), len(encoded))
+	}
+}
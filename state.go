@@ -1,11 +1,12 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"os"
 )
 
-const stateFormat = "%s\n%s\n"
+const stateFormat = "%s\n%s\n%s\n"
 const mapSize = 64
 
 type State struct {
@@ -22,6 +23,22 @@ func OpenState(fn string) (State, error) {
 	return s, nil
 }
 
+// ReadState returns the state saved in the given file, like LastState,
+// without creating the file or opening it for writing. A missing file
+// is the same as an empty one.
+func ReadState(fn string) (bootId, seqToken, cursor string, err error) {
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return "", "", "", nil
+	} else if err != nil {
+		return "", "", "", err
+	}
+	defer f.Close()
+
+	bootId, seqToken, cursor = State{f}.LastState()
+	return bootId, seqToken, cursor, nil
+}
+
 func (s State) Close() error {
 	return s.file.Close()
 }
@@ -30,28 +47,35 @@ func (s State) Sync() error {
 	return s.file.Sync()
 }
 
-func (s State) LastState() (string, string) {
-	var bootId string
-	var seqToken string
+// LastState returns the boot id, Cloudwatch sequence token and journal
+// cursor that were last saved. Any that aren't known are returned as empty
+// strings. State files written before cursors were saved have only the first
+// two lines.
+func (s State) LastState() (string, string, string) {
+	var lines [3]string
 	_, err := s.file.Seek(0, 0)
 	if err != nil {
-		return "", ""
+		return "", "", ""
 	}
-	n, err := fmt.Fscanf(s.file, stateFormat, &bootId, &seqToken)
-	if err != nil || n < 2 {
-		return "", ""
+	scanner := bufio.NewScanner(s.file)
+	for i := range lines {
+		if !scanner.Scan() {
+			break
+		}
+		lines[i] = scanner.Text()
 	}
-	return bootId, seqToken
+	return lines[0], lines[1], lines[2]
 }
 
-func (s State) SetState(bootId, seqToken string) error {
+func (s State) SetState(bootId, seqToken, cursor string) error {
 	_, err := s.file.Seek(0, 0)
 	if err != nil {
 		return err
 	}
-	_, err = fmt.Fprintf(s.file, stateFormat, bootId, seqToken)
+	n, err := fmt.Fprintf(s.file, stateFormat, bootId, seqToken, cursor)
 	if err != nil {
 		return err
 	}
-	return nil
+	// Don't leave the tail of a longer previous state behind.
+	return s.file.Truncate(int64(n))
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// healthStallTimeout is how long the reader or a write can go without
+	// making progress before the service is reported as unhealthy.
+	healthStallTimeout = 5 * time.Minute
+
+	// healthErrorWindow is how long an error leaves the service reported
+	// as degraded.
+	healthErrorWindow = 5 * time.Minute
+)
+
+// The health verdicts reported by the status API.
+const (
+	healthStarting  = "starting"
+	healthOK        = "healthy"
+	healthDegraded  = "degraded"
+	healthUnhealthy = "unhealthy"
+)
+
+// Status is the state of the service, as returned by the status API.
+type Status struct {
+	Health  string   `json:"health"`
+	Reasons []string `json:"reasons,omitempty"`
+
+	BootId     string     `json:"bootId"`
+	Cursor     string     `json:"cursor"`
+	LastCommit *time.Time `json:"lastCommit"`
+
+	Outputs []OutputStatus `json:"outputs"`
+	Backlog BacklogStatus  `json:"backlog"`
+	Spool   SpoolStatus    `json:"spool"`
+
+	RecentErrors []activityError `json:"recentErrors"`
+}
+
+type OutputStatus struct {
+	Name         string     `json:"name"`
+	LastDelivery *time.Time `json:"lastDelivery"`
+}
+
+// BacklogStatus estimates how much of the journal is yet to be delivered:
+// the records that have been read but not delivered everywhere, and
+// whether there's anything in the journal that hasn't been read yet. If
+// lag metrics are enabled, the journal entries after the last delivered
+// one are also counted.
+type BacklogStatus struct {
+	PendingRecords int     `json:"pendingRecords"`
+	CaughtUp       bool    `json:"caughtUp"`
+	LagSeconds     float64 `json:"lagSeconds"`
+
+	JournalLagSeconds *float64 `json:"journalLagSeconds,omitempty"`
+	JournalLagEntries *uint64  `json:"journalLagEntries,omitempty"`
+}
+
+type SpoolStatus struct {
+	PendingBatches    int `json:"pendingBatches"`
+	MaxPendingBatches int `json:"maxPendingBatches"`
+}
+
+// status reports the current activity, judging the service's health.
+func (a *activity) status(now time.Time, bootId string) *Status {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	status := &Status{
+		Health: healthOK,
+		BootId: bootId,
+		Cursor: a.cursor,
+		Backlog: BacklogStatus{
+			PendingRecords: a.pendingRecords,
+			CaughtUp:       a.caughtUp,
+			LagSeconds:     a.lag.Seconds(),
+		},
+		Spool: SpoolStatus{
+			PendingBatches:    a.pendingBatches,
+			MaxPendingBatches: a.maxPendingBatches,
+		},
+		Outputs:      []OutputStatus{},
+		RecentErrors: append([]activityError{}, a.errors...),
+	}
+	if a.journalLag != nil {
+		seconds, entries := a.journalLag.Time.Seconds(), a.journalLag.Entries
+		status.Backlog.JournalLagSeconds = &seconds
+		status.Backlog.JournalLagEntries = &entries
+	}
+	if !a.lastCommit.IsZero() {
+		lastCommit := a.lastCommit
+		status.LastCommit = &lastCommit
+	}
+
+	var names []string
+	for name := range a.deliveries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		output := OutputStatus{Name: name}
+		if delivered := a.deliveries[name]; !delivered.IsZero() {
+			output.LastDelivery = &delivered
+		}
+		status.Outputs = append(status.Outputs, output)
+	}
+
+	if err := a.stalledLocked(now, healthStallTimeout); err != nil {
+		status.Health = healthUnhealthy
+		status.Reasons = append(status.Reasons, err.Error())
+	} else if !a.readyLocked() && !(a.caughtUp && a.pendingBatches == 0) {
+		status.Health = healthStarting
+		status.Reasons = append(status.Reasons, "nothing has been delivered, and the journal hasn't been read up to date yet")
+	} else if n := len(a.errors); n > 0 && now.Sub(a.errors[n-1].Time) < healthErrorWindow {
+		status.Health = healthDegraded
+		status.Reasons = append(status.Reasons, "an error occurred recently")
+	}
+	return status
+}
+
+// ServeStatus serves the status API on the given address (see
+// listenLocal), returning once it's listening. /status returns the full
+// Status as JSON, while /health only returns the health verdict, with a
+// 503 status code unless the service is healthy or degraded.
+func ServeStatus(address, bootId string) error {
+	listener, err := listenLocal(address)
+	if err != nil {
+		return fmt.Errorf("unable to listen for status requests: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		status := pipelineActivity.status(time.Now(), bootId)
+		writeStatus(w, status.Health, status)
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		status := pipelineActivity.status(time.Now(), bootId)
+		writeStatus(w, status.Health, &struct {
+			Health  string   `json:"health"`
+			Reasons []string `json:"reasons,omitempty"`
+		}{status.Health, status.Reasons})
+	})
+	server := &http.Server{
+		Handler:     mux,
+		ReadTimeout: 10 * time.Second,
+	}
+	go server.Serve(listener)
+	return nil
+}
+
+func writeStatus(w http.ResponseWriter, health string, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if health != healthOK && health != healthDegraded {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	w.Write(body)
+	w.Write([]byte{'\n'})
+}
+
+// listenLocal listens on a TCP address like 127.0.0.1:9469, or on a unix
+// socket if the address is an absolute path or starts with "unix:". A
+// socket left behind by an earlier run is replaced.
+func listenLocal(address string) (net.Listener, error) {
+	if !strings.HasPrefix(address, "unix:") && !strings.HasPrefix(address, "/") {
+		return net.Listen("tcp", address)
+	}
+
+	path := strings.TrimPrefix(address, "unix:")
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
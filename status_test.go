@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStatusHealth(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name  string
+		setup func(a *activity)
+		want  string
+	}{
+		{
+			name:  "just started",
+			setup: func(a *activity) {},
+			want:  healthStarting,
+		},
+		{
+			name: "caught up with batches pending",
+			setup: func(a *activity) {
+				a.setCaughtUp(true)
+				a.setPending([]*pendingBatch{{records: batchWithCursor("c1")}})
+			},
+			want: healthStarting,
+		},
+		{
+			name: "caught up with nothing pending",
+			setup: func(a *activity) {
+				a.setCaughtUp(true)
+			},
+			want: healthOK,
+		},
+		{
+			name: "nothing to deliver",
+			setup: func(a *activity) {
+				a.nothingToDeliver()
+				a.setCaughtUp(false)
+			},
+			want: healthOK,
+		},
+		{
+			name: "delivered",
+			setup: func(a *activity) {
+				a.acked("c1", batchWithCursor("c1"))
+			},
+			want: healthOK,
+		},
+		{
+			name: "recent error",
+			setup: func(a *activity) {
+				a.acked("c1", batchWithCursor("c1"))
+				a.failed(errors.New("no"))
+			},
+			want: healthDegraded,
+		},
+		{
+			name: "reader stalled",
+			setup: func(a *activity) {
+				a.setCaughtUp(true)
+				a.lastRead = now.Add(-2 * healthStallTimeout)
+			},
+			want: healthUnhealthy,
+		},
+	}
+
+	for _, test := range tests {
+		a := newActivity()
+		test.setup(a)
+		status := a.status(now, "boot")
+		if status.Health != test.want {
+			t.Errorf("%s: health is %s (%q), want %s", test.name, status.Health, status.Reasons, test.want)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/coreos/go-systemd/sdjournal"
+)
+
+// Backlog is the part of the journal that hasn't been delivered yet.
+type Backlog struct {
+	Entries uint64
+
+	// AtLeast is set if the entries stopped being counted at
+	// maxLagEntries.
+	AtLeast bool
+
+	First, Last time.Time
+}
+
+// ShowStatus writes a report of what the daemon would do if it were
+// started with the given config: where it would resume reading the
+// journal, how much it would have to catch up on, and where it would send
+// the records. The state file and journal are only read. AWS is only
+// consulted, to identify the host and describe the Cloudwatch Logs streams,
+// if queryAWS is set.
+func ShowStatus(w io.Writer, filename string, overrides []string, queryAWS bool) error {
+	config, err := loadConfigFor(filename, overrides, queryAWS)
+	if err != nil {
+		return fmt.Errorf("error reading config: %s", err)
+	}
+
+	lastBootId, seqToken, cursor, err := ReadState(config.StateFilename)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %s", config.StateFilename, err)
+	}
+
+	journal, err := OpenJournal(config, nil)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	bootId, resume, err := seekResume(journal, lastBootId, cursor)
+	if err != nil {
+		return err
+	}
+	backlog, err := measureBacklog(journal, resume)
+	if err != nil {
+		return fmt.Errorf("unable to measure the backlog: %s", err)
+	}
+
+	report := &statusReport{w: w}
+	report.line("Host", "%s (from %s)", config.InstanceId, config.HostIdentity.Provider)
+	if config.IdentityOffline {
+		report.line("", "ec2 was skipped, as AWS wasn't consulted; the daemon may identify")
+		report.line("", "the host differently, and name its streams differently. Add -aws")
+		report.line("", "to identify the host as the daemon would")
+	}
+	report.line("State file", "%s", config.StateFilename)
+	report.line("Saved boot id", "%s", orNone(lastBootId))
+	report.line("Journal boot id", "%s", bootId)
+	if config.UseSeqTokens {
+		report.line("Sequence token", "%s", orNone(seqToken))
+	}
+	report.line("Saved cursor", "%s", orNone(cursor))
+	if cursor != "" {
+		if resume == resumeAfterCursor {
+			report.line("", "still in the journal")
+		} else {
+			report.line("", "vacuumed from the journal")
+		}
+	}
+
+	switch resume {
+	case resumeAfterCursor:
+		report.line("On restart", "resume after the saved cursor")
+	case resumeAtTail:
+		report.line("On restart", "skip to the end of the journal, as the boot id hasn't changed")
+		report.line("", "entries added while stopped will not be sent")
+	case resumeAtHead:
+		report.line("On restart", "start from the beginning of the journal")
+	}
+
+	if backlog.Entries == 0 {
+		report.line("Backlog", "none")
+	} else {
+		atLeast := ""
+		if backlog.AtLeast {
+			atLeast = "at least "
+		}
+		report.line("Backlog", "%s%d entries", atLeast, backlog.Entries)
+		report.line("", "from %s", backlog.First.Format(time.RFC3339))
+		report.line("", "to %s (%s)", backlog.Last.Format(time.RFC3339), backlog.Last.Sub(backlog.First))
+	}
+
+	if config.LogPriority < DEBUG {
+		priority := strings.Trim(string(PriorityJSON[config.LogPriority]), `"`)
+		report.line("Filters", "priority %s or more important", priority)
+	} else {
+		report.line("Filters", "none")
+	}
+
+	report.outputs(config, queryAWS)
+	return report.err
+}
+
+// measureBacklog returns the entries that would be read after resuming in
+// the given mode. The journal must be positioned by seekResume.
+func measureBacklog(journal *sdjournal.Journal, resume resumeMode) (Backlog, error) {
+	var backlog Backlog
+	switch resume {
+	case resumeAtTail:
+		// Nothing already in the journal is read.
+		return backlog, nil
+	case resumeAfterCursor:
+		// The journal is on the entry we last delivered.
+		n, err := journal.Next()
+		if err != nil || n == 0 {
+			return backlog, err
+		}
+	}
+
+	first, err := journal.GetRealtimeUsec()
+	if err != nil {
+		return backlog, err
+	}
+	more, atLeast, err := countEntries(journal)
+	if err != nil {
+		return backlog, err
+	}
+	last, err := journal.GetRealtimeUsec()
+	if err != nil {
+		return backlog, err
+	}
+
+	backlog.Entries = more + 1
+	backlog.AtLeast = atLeast
+	backlog.First = time.Unix(0, int64(first)*int64(time.Microsecond))
+	backlog.Last = time.Unix(0, int64(last)*int64(time.Microsecond))
+	return backlog, nil
+}
+
+// statusReport writes the lines of the status report, keeping the first
+// error.
+type statusReport struct {
+	w   io.Writer
+	err error
+}
+
+func (r *statusReport) line(label, format string, args ...interface{}) {
+	if r.err != nil {
+		return
+	}
+	if label != "" {
+		label += ":"
+	}
+	line := fmt.Sprintf("%-17s "+format, append([]interface{}{label}, args...)...)
+	_, r.err = io.WriteString(r.w, strings.TrimRight(line, " ")+"\n")
+}
+
+func (r *statusReport) outputs(config *Config, queryAWS bool) {
+	r.line("Outputs", "")
+
+	var cwClient *cloudwatchlogs.CloudWatchLogs
+	if queryAWS {
+		cwClient = config.NewCloudWatchClient(config.NewAWSSession())
+	}
+	// Stream names that may depend on the host's identity are marked if
+	// it may not be the one the daemon would use.
+	unsure := ""
+	if config.IdentityOffline {
+		unsure = " (without -aws)"
+	}
+	stream := func(label, logGroupName, logStreamName string, client *cloudwatchlogs.CloudWatchLogs) {
+		r.line("  "+label, "%s/%s%s", logGroupName, logStreamName, unsure)
+		if client != nil {
+			r.line("", "%s", describeStreamStatus(client, logGroupName, logStreamName))
+		}
+	}
+
+	if config.LogGroupName != "" {
+		stream("cloudwatch logs", config.LogGroupName, config.LogStreamName, cwClient)
+	}
+	for _, dest := range config.Destinations {
+		client := cwClient
+		if queryAWS && dest.AWSCredentials != nil {
+			client = config.NewCloudWatchClient(config.NewAWSSessionWithCredentials(dest.AWSCredentials))
+		}
+		stream("destination "+dest.Name, dest.LogGroupName, dest.LogStreamName, client)
+		if dest.Role != nil {
+			r.line("", "as %s", dest.Role.RoleARN)
+		}
+	}
+	if config.LagMetrics != nil {
+		stream("lag metrics", config.LagMetrics.LogGroupName, config.LagMetrics.LogStreamName, cwClient)
+	}
+	if config.MetricRules != nil {
+		stream("metric rules", config.MetricRules.LogGroupName, config.MetricRules.LogStreamName, cwClient)
+		names := make([]string, len(config.MetricRules.Rules))
+		for i, rule := range config.MetricRules.Rules {
+			names[i] = rule.Name
+		}
+		r.line("", "rules %s", strings.Join(names, ", "))
+	}
+	if config.FileSink != nil {
+		r.line("  file", "%s (%s)", config.FileSink.Path, config.FileSink.Format)
+	}
+	if config.SyslogSink != nil {
+		r.line("  syslog", "%s://%s", config.SyslogSink.Protocol, config.SyslogSink.Address)
+	}
+	if config.LokiSink != nil {
+		r.line("  loki", "%s", config.LokiSink.URL)
+	}
+	if config.ESSink != nil {
+		r.line("  elasticsearch", "%s (index %s)", config.ESSink.URL, config.ESSink.Index)
+	}
+	if config.OTLPSink != nil {
+		r.line("  otlp", "%s (%s)", config.OTLPSink.Endpoint, config.OTLPSink.Protocol)
+	}
+}
+
+// describeStreamStatus summarizes what Cloudwatch Logs knows of the given
+// stream.
+func describeStreamStatus(client *cloudwatchlogs.CloudWatchLogs, logGroupName, logStreamName string) string {
+	stream, err := describeStream(client, logGroupName, logStreamName)
+	if err != nil {
+		return fmt.Sprintf("unable to describe the stream: %s", err)
+	}
+	if stream == nil {
+		return "the stream doesn't exist yet"
+	}
+	if stream.LastEventTimestamp == nil {
+		return "the stream has no events"
+	}
+	status := "last event at " + millisTime(*stream.LastEventTimestamp).Format(time.RFC3339)
+	if stream.LastIngestionTime != nil {
+		status += ", ingested at " + millisTime(*stream.LastIngestionTime).Format(time.RFC3339)
+	}
+	return status
+}
+
+func millisTime(ms int64) time.Time {
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "none"
+	}
+	return s
+}
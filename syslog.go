@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	syslogDialTimeout  = 10 * time.Second
+	syslogWriteTimeout = 30 * time.Second
+	syslogMaxBackoff   = 30 * time.Second
+)
+
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+func getSyslogFacility(facility string) (int, error) {
+	if n, ok := syslogFacilities[facility]; ok {
+		return n, nil
+	}
+	n, err := strconv.Atoi(facility)
+	if err != nil || n < 0 || n > 23 {
+		return 0, fmt.Errorf("'%s' is not a syslog facility", facility)
+	}
+	return n, nil
+}
+
+// SyslogSink forwards records to a syslog server as RFC 5424 messages.
+type SyslogSink struct {
+	config    *SyslogSinkConfig
+	tlsConfig *tls.Config
+	conn      net.Conn
+	backoff   time.Duration
+}
+
+func NewSyslogSink(config *SyslogSinkConfig) (*SyslogSink, error) {
+	s := &SyslogSink{
+		config: config,
+	}
+	if config.Protocol == "tls" {
+		tlsConfig, err := config.TLS.Load()
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(config.Address)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.ServerName = host
+		}
+		s.tlsConfig = tlsConfig
+	}
+	return s, nil
+}
+
+func (s *SyslogSink) Name() string {
+	return "syslog " + s.config.Address
+}
+
+// WriteBatch sends each record as a separate message, reconnecting with
+// an increasing delay if the connection fails. The whole batch is sent
+// again after a reconnect, since there's no way to know how much of it
+// the server received.
+func (s *SyslogSink) WriteBatch(records []Record) error {
+	msgs := make([][]byte, len(records))
+	for i := range records {
+		msgs[i] = s.formatMessage(&records[i])
+	}
+
+	var err error
+	for attempt := 0; attempt <= s.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(s.nextBackoff())
+		}
+		err = s.send(msgs)
+		if err == nil {
+			s.backoff = 0
+			return nil
+		}
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+	}
+	return err
+}
+
+func (s *SyslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *SyslogSink) nextBackoff() time.Duration {
+	if s.backoff == 0 {
+		s.backoff = time.Second
+	} else {
+		s.backoff *= 2
+	}
+	if s.backoff > syslogMaxBackoff {
+		s.backoff = syslogMaxBackoff
+	}
+	return s.backoff
+}
+
+func (s *SyslogSink) send(msgs [][]byte) error {
+	if s.conn == nil {
+		err := s.connect()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+
+	if s.config.Protocol == "udp" {
+		// Each datagram carries exactly one message.
+		for _, msg := range msgs {
+			_, err := s.conn.Write(msg)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Over a stream we use RFC 6587 octet-counting framing.
+	var buf bytes.Buffer
+	for _, msg := range msgs {
+		buf.WriteString(strconv.Itoa(len(msg)))
+		buf.WriteByte(' ')
+		buf.Write(msg)
+	}
+	_, err := s.conn.Write(buf.Bytes())
+	return err
+}
+
+func (s *SyslogSink) connect() error {
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+
+	var conn net.Conn
+	var err error
+	switch s.config.Protocol {
+	case "tls":
+		conn, err = tls.DialWithDialer(dialer, "tcp", s.config.Address, s.tlsConfig)
+	default:
+		conn, err = dialer.Dial(s.config.Protocol, s.config.Address)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// formatMessage renders a record as an RFC 5424 syslog message.
+func (s *SyslogSink) formatMessage(record *Record) []byte {
+	var buf bytes.Buffer
+
+	facility := s.config.Facility
+	if record.Syslog.Facility != 0 || record.Transport == "kernel" {
+		facility = record.Syslog.Facility
+	}
+	fmt.Fprintf(&buf, "<%d>1 ", facility*8+int(record.Priority))
+
+	buf.WriteString(record.Time().UTC().Format("2006-01-02T15:04:05.000000Z"))
+	buf.WriteByte(' ')
+
+	buf.WriteString(syslogHeaderField(record.Hostname, 255))
+	buf.WriteByte(' ')
+
+	appName := record.Syslog.Identifier
+	if appName == "" {
+		appName = record.Command
+	}
+	buf.WriteString(syslogHeaderField(appName, 48))
+	buf.WriteByte(' ')
+
+	pid := record.Syslog.PID
+	if pid == 0 {
+		pid = record.PID
+	}
+	procId := ""
+	if pid != 0 {
+		procId = strconv.Itoa(pid)
+	}
+	buf.WriteString(syslogHeaderField(procId, 128))
+	buf.WriteByte(' ')
+
+	buf.WriteString(syslogHeaderField(record.MessageId, 32))
+	buf.WriteByte(' ')
+
+	s.writeStructuredData(&buf, record)
+
+	if record.Message != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(record.Message)
+	}
+
+	return buf.Bytes()
+}
+
+// writeStructuredData writes the journal fields that have no place in the
+// syslog header as a single SD-ELEMENT.
+func (s *SyslogSink) writeStructuredData(buf *bytes.Buffer, record *Record) {
+	params := [][2]string{
+		{"instanceId", record.InstanceId},
+		{"uid", strconv.Itoa(record.UID)},
+		{"gid", strconv.Itoa(record.GID)},
+		{"exe", record.Executable},
+		{"cmdLine", record.CommandLine},
+		{"systemdUnit", record.SystemdUnit},
+		{"bootId", record.BootId},
+		{"machineId", record.MachineId},
+		{"transport", record.Transport},
+		{"containerName", record.Container_Name},
+		{"containerTag", record.Container_Tag},
+		{"containerID", record.Container_ID},
+		{"kernelDevice", record.Kernel.Device},
+		{"kernelSubsystem", record.Kernel.Subsystem},
+		{"udevSysName", record.Kernel.SysName},
+		{"udevDevNode", record.Kernel.DevNode},
+	}
+	if record.Errno != 0 {
+		params = append(params, [2]string{"errno", strconv.Itoa(record.Errno)})
+	}
+
+	buf.WriteByte('[')
+	buf.WriteString(s.config.StructuredDataId)
+	for _, param := range params {
+		if param[1] == "" {
+			continue
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(param[0])
+		buf.WriteString(`="`)
+		buf.WriteString(syslogParamEscaper.Replace(param[1]))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte(']')
+}
+
+var syslogParamEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// syslogHeaderField returns the given value as a header field, which may
+// only contain printable ASCII characters other than space, or "-" if
+// the value is empty.
+func syslogHeaderField(value string, maxLen int) string {
+	field := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return -1
+		}
+		return r
+	}, value)
+	if len(field) > maxLen {
+		field = field[:maxLen]
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/coreos/go-systemd/sdjournal"
+)
+
+// tailLines is how many of the latest entries tail starts with when it
+// isn't given a time to start from.
+const tailLines = 10
+
+// timeFormats are the formats accepted for times given on the command
+// line, besides a duration before now. They're in local time.
+var timeFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+// Tail prints the events that would be sent for the latest journal entries,
+// or for those since the given time, and then for new entries too if
+// follow is set. Records are read, filtered and encoded as they would be by
+// the daemon, but the state file isn't used, and neither is AWS unless
+// queryAWS is set, to identify the host. If any units are given, only their
+// entries are printed.
+func Tail(w io.Writer, filename string, overrides []string, queryAWS bool, since string, follow bool, units []string) error {
+	config, err := loadConfigFor(filename, overrides, queryAWS)
+	if err != nil {
+		return fmt.Errorf("error reading config: %s", err)
+	}
+
+	journal, err := OpenJournal(config, units)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	var seeked uint64
+	if since != "" {
+		start, err := parseTime(since, time.Now())
+		if err != nil {
+			return err
+		}
+		err = journal.SeekRealtimeUsec(uint64(start.UnixNano() / int64(time.Microsecond)))
+		if err != nil {
+			return fmt.Errorf("unable to seek in journal: %s", err)
+		}
+		n, err := journal.Next()
+		if err != nil {
+			return fmt.Errorf("unable to seek in journal: %s", err)
+		}
+		seeked = uint64(n)
+	} else {
+		journal.SeekTail()
+		seeked, err = journal.PreviousSkip(tailLines)
+		if err != nil {
+			return fmt.Errorf("unable to seek in journal: %s", err)
+		}
+	}
+
+	skip := uint64(0)
+	if seeked == 0 {
+		// There's nothing to print yet, so when following we start
+		// after the last entry.
+		if !follow {
+			return nil
+		}
+		journal.SeekTail()
+		seeked, err = journal.Previous()
+		if seeked == 0 || err != nil {
+			return fmt.Errorf("there are no matching entries in the journal to follow")
+		}
+		skip = 1
+	}
+
+	return PrintRecords(w, config, journal, skip, follow)
+}
+
+// DryRun prints the events that the daemon would send if it were started
+// now, starting from the position saved in the state file, without
+// updating the state file. AWS is only used if queryAWS is set, to identify
+// the host.
+func DryRun(w io.Writer, filename string, overrides []string, queryAWS bool) error {
+	config, err := loadConfigFor(filename, overrides, queryAWS)
+	if err != nil {
+		return fmt.Errorf("error reading config: %s", err)
+	}
+
+	lastBootId, _, cursor, err := ReadState(config.StateFilename)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s: %s", config.StateFilename, err)
+	}
+
+	journal, err := OpenJournal(config, nil)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	_, resume, err := seekResume(journal, lastBootId, cursor)
+	if err != nil {
+		return err
+	}
+	skip := uint64(0)
+	if resume != resumeAtHead {
+		// As in run, the journal is on an entry already delivered.
+		skip = 1
+	}
+
+	return PrintRecords(w, config, journal, skip, true)
+}
+
+// PrintRecords reads records from the journal, from its current position,
+// and writes them to w through the same pipeline that the daemon uses.
+func PrintRecords(w io.Writer, config *Config, journal *sdjournal.Journal, skip uint64, follow bool) error {
+	sink, err := NewPrintSink(w, config.Format)
+	if err != nil {
+		return err
+	}
+
+	records := make(chan Record)
+	batches := make(chan []Record)
+	go ReadRecords(config, journal, records, skip, follow, nil)
+	go BatchRecords(records, batches, config.BufferSize)
+
+	pipeline := NewPipeline(
+		[]LaneConfig{{Sink: sink}},
+		config.MaxConcurrentRequests,
+		config.MaxPendingBatches,
+		"",
+		func(cursor string) error { return nil },
+	)
+	for batch := range batches {
+		if pipeline.Submit(batch) != nil {
+			break
+		}
+	}
+	return pipeline.Close()
+}
+
+// PrintSink writes each event to w as it would be sent to Cloudwatch Logs,
+// one per line.
+type PrintSink struct {
+	w      *bufio.Writer
+	encode Encoder
+}
+
+func NewPrintSink(w io.Writer, format string) (*PrintSink, error) {
+	encode, err := GetEncoder(format)
+	if err != nil {
+		return nil, err
+	}
+	return &PrintSink{bufio.NewWriter(w), encode}, nil
+}
+
+func (s *PrintSink) Name() string {
+	return "stdout"
+}
+
+func (s *PrintSink) WriteBatch(records []Record) error {
+	for i := range records {
+		data, err := s.encode(&records[i])
+		if err != nil {
+			return err
+		}
+		s.w.Write(data)
+		s.w.WriteByte('\n')
+	}
+	return s.w.Flush()
+}
+
+func (s *PrintSink) Close() error {
+	return s.w.Flush()
+}
+
+// parseTime parses a time given on the command line, which is either in
+// one of timeFormats or a duration before now.
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	for _, format := range timeFormats {
+		if t, err := time.ParseInLocation(format, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("'%s' is not a valid time; use e.g. \"2006-01-02 15:04:05\" or a duration like 1h", s)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig holds the TLS settings shared by the network outputs.
+type TLSConfig struct {
+	CAFile             string
+	CertFile           string
+	KeyFile            string
+	ServerName         string
+	InsecureSkipVerify bool
+}
+
+type tlsConfig struct {
+	CAFile             string `hcl:"ca_file"`
+	CertFile           string `hcl:"cert_file"`
+	KeyFile            string `hcl:"key_file"`
+	ServerName         string `hcl:"server_name"`
+	InsecureSkipVerify bool   `hcl:"insecure_skip_verify"`
+}
+
+func (c tlsConfig) resolve() (TLSConfig, error) {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return TLSConfig{}, fmt.Errorf("cert_file and key_file must be set together")
+	}
+	return TLSConfig(c), nil
+}
+
+// Load builds a crypto/tls configuration, reading any certificate files
+// from disk.
+func (c TLSConfig) Load() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -12,9 +12,16 @@ import (
 func UnmarshalRecord(journal *sdjournal.Journal, to *Record) error {
 	err := unmarshalRecord(journal, reflect.ValueOf(to).Elem())
 	if err == nil {
-		// FIXME: Should use the realtime from the log record,
-		// but for some reason journal.GetRealtimeUsec always fails.
-		to.TimeUsec = time.Now().Unix() * 1000
+		// Events are timestamped with their entry's own time, so that
+		// the time between an entry being logged and being delivered
+		// can be measured. If it can't be read for some reason, the
+		// time it was read will have to do.
+		usec, err := journal.GetRealtimeUsec()
+		if err == nil {
+			to.TimeUsec = int64(usec / 1000)
+		} else {
+			to.TimeUsec = time.Now().Unix() * 1000
+		}
 	}
 	return err
 }
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// VerifyOptions selects the journal entries to look for, and the stream to
+// look for them in.
+type VerifyOptions struct {
+	JournalRange
+	LogGroupName  string
+	LogStreamName string
+}
+
+// verifyEntry is a journal entry that should have been sent, or an event
+// that was.
+type verifyEntry struct {
+	Time    time.Time
+	Cursor  string
+	Hash    [sha256.Size]byte
+	Message string
+}
+
+// VerifyResult is the outcome of comparing the entries in a range of the
+// journal with the events in a stream.
+type VerifyResult struct {
+	Entries []verifyEntry
+	Events  []verifyEntry
+
+	// Missing are the entries without an event, and Duplicated those
+	// with more than one. Reordered are the entries whose events came
+	// after the event of an entry that followed them in the journal.
+	Missing    []verifyEntry
+	Duplicated []verifyEntry
+	Reordered  []verifyEntry
+
+	// Unexpected is the number of events that don't match any of the
+	// entries, such as the program's own error reports, or events
+	// from just outside the range.
+	Unexpected int
+}
+
+// OK returns true if every entry was found once, in order.
+func (r *VerifyResult) OK() bool {
+	return len(r.Missing) == 0 && len(r.Duplicated) == 0 && len(r.Reordered) == 0
+}
+
+// Verify checks that every journal entry in the range is in the Cloudwatch
+// Logs stream exactly once and in order, and writes a report of any that
+// aren't to w. Entries are matched with events by the cursor in the event,
+// if include_cursor was set when it was sent, and otherwise by a hash of
+// the event as it would be sent now. An error is returned if the stream
+// doesn't match the journal.
+func Verify(w io.Writer, filename string, overrides []string, opts VerifyOptions) error {
+	config, err := LoadConfig(filename, overrides)
+	if err != nil {
+		return fmt.Errorf("error reading config: %s", err)
+	}
+
+	err = opts.JournalRange.Check()
+	if err != nil {
+		return err
+	}
+	if opts.LogGroupName == "" {
+		if config.LogGroupName == "" {
+			return fmt.Errorf("verify requires -log-group when log_group isn't set")
+		}
+		opts.LogGroupName = config.LogGroupName
+	}
+	if opts.LogStreamName == "" {
+		opts.LogStreamName = config.LogStreamName
+	}
+
+	encode, err := GetEncoder(config.Format)
+	if err != nil {
+		return err
+	}
+	var entries []verifyEntry
+	err = ReadRange(config, opts.JournalRange, func(record *Record) error {
+		// An event with a cursor is matched by it, so the hash is of
+		// the event without one.
+		record.JournalCursor = ""
+		data, err := encode(record)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, verifyEntry{
+			Time:    record.Time(),
+			Cursor:  record.Cursor,
+			Hash:    sha256.Sum256(data),
+			Message: record.Message,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Events are timestamped with their entry's time, so only those
+	// between the first and last entries can match.
+	start, end := opts.Since, opts.Until
+	if len(entries) > 0 {
+		if start.IsZero() {
+			start = entries[0].Time
+		}
+		if end.IsZero() {
+			end = entries[len(entries)-1].Time.Add(time.Millisecond)
+		}
+	} else if end.IsZero() {
+		end = time.Now()
+	}
+
+	client := config.NewCloudWatchClient(config.NewAWSSession())
+	events, err := fetchEvents(client, opts.LogGroupName, opts.LogStreamName, start, end)
+	if err != nil {
+		return fmt.Errorf("unable to get events from %s/%s: %s", opts.LogGroupName, opts.LogStreamName, err)
+	}
+
+	result := compareEvents(entries, events)
+	err = writeVerifyReport(w, opts, result)
+	if err != nil {
+		return err
+	}
+	if !result.OK() {
+		return fmt.Errorf("%s/%s doesn't match the journal", opts.LogGroupName, opts.LogStreamName)
+	}
+	return nil
+}
+
+// fetchEvents returns the events in the stream from start up to end, in
+// the order Cloudwatch Logs holds them. An event's Cursor is set if it has
+// one embedded.
+func fetchEvents(client *cloudwatchlogs.CloudWatchLogs, logGroupName, logStreamName string, start, end time.Time) ([]verifyEntry, error) {
+	var events []verifyEntry
+	err := getLogEvents(client, logGroupName, logStreamName, start, end, func(event *cloudwatchlogs.OutputLogEvent) error {
+		events = append(events, newEventEntry(event))
+		return nil
+	})
+	return events, err
+}
+
+// getLogEvents calls fn with each of the events in the stream from start
+// up to end, oldest first, until fn returns an error. Zero times leave
+// that end of the stream open.
+func getLogEvents(client *cloudwatchlogs.CloudWatchLogs, logGroupName, logStreamName string, start, end time.Time, fn func(event *cloudwatchlogs.OutputLogEvent) error) error {
+	request := &cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  &logGroupName,
+		LogStreamName: &logStreamName,
+		StartFromHead: aws.Bool(true),
+	}
+	if !start.IsZero() {
+		request.StartTime = aws.Int64(start.UnixNano() / int64(time.Millisecond))
+	}
+	if !end.IsZero() {
+		request.EndTime = aws.Int64(end.UnixNano() / int64(time.Millisecond))
+	}
+
+	for {
+		page, err := client.GetLogEvents(request)
+		if err != nil {
+			return err
+		}
+		for _, event := range page.Events {
+			err = fn(event)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The same token is returned again once the end of the
+		// stream is reached.
+		if page.NextForwardToken == nil || (request.NextToken != nil && *page.NextForwardToken == *request.NextToken) {
+			return nil
+		}
+		request.NextToken = page.NextForwardToken
+	}
+}
+
+func newEventEntry(event *cloudwatchlogs.OutputLogEvent) verifyEntry {
+	message := aws.StringValue(event.Message)
+	entry := verifyEntry{
+		Time:    millisTime(aws.Int64Value(event.Timestamp)),
+		Message: message,
+	}
+
+	var embedded struct {
+		Cursor  string `json:"cursor"`
+		Message string `json:"message"`
+	}
+	if strings.HasPrefix(message, "{") && json.Unmarshal([]byte(message), &embedded) == nil {
+		entry.Cursor = embedded.Cursor
+		entry.Message = embedded.Message
+	}
+	if entry.Cursor == "" {
+		entry.Hash = sha256.Sum256([]byte(message))
+	}
+	return entry
+}
+
+// compareEvents matches each of the events with the entry it came from.
+func compareEvents(entries, events []verifyEntry) *VerifyResult {
+	result := &VerifyResult{Entries: entries, Events: events}
+
+	byCursor := map[string]int{}
+	byHash := map[[sha256.Size]byte][]int{}
+	for i, entry := range entries {
+		byCursor[entry.Cursor] = i
+		byHash[entry.Hash] = append(byHash[entry.Hash], i)
+	}
+
+	found := make([]int, len(entries))
+	latest := -1
+	for _, event := range events {
+		i := -1
+		if event.Cursor != "" {
+			if j, ok := byCursor[event.Cursor]; ok {
+				i = j
+			}
+		} else if candidates := byHash[event.Hash]; len(candidates) > 0 {
+			// Identical entries are matched in turn.
+			i = candidates[0]
+			for _, j := range candidates {
+				if found[j] == 0 {
+					i = j
+					break
+				}
+			}
+		}
+
+		if i < 0 {
+			result.Unexpected++
+			continue
+		}
+		found[i]++
+		if found[i] == 2 {
+			result.Duplicated = append(result.Duplicated, entries[i])
+		} else if found[i] == 1 && i < latest {
+			result.Reordered = append(result.Reordered, entries[i])
+		}
+		if i > latest {
+			latest = i
+		}
+	}
+
+	for i, n := range found {
+		if n == 0 {
+			result.Missing = append(result.Missing, entries[i])
+		}
+	}
+	return result
+}
+
+func writeVerifyReport(w io.Writer, opts VerifyOptions, result *VerifyResult) error {
+	report := &statusReport{w: w}
+	report.line("Journal", "%d entries%s", len(result.Entries), entriesSpan(result.Entries))
+	report.line("Cloudwatch", "%d events in %s/%s%s", len(result.Events), opts.LogGroupName, opts.LogStreamName, entriesSpan(result.Events))
+
+	list := func(label string, entries []verifyEntry) {
+		report.line(label, "%d", len(entries))
+		for _, entry := range entries {
+			report.line("", "%s %s %s", entry.Time.Format(time.RFC3339Nano), entry.Cursor, abbreviate(entry.Message, 60))
+		}
+	}
+	list("Missing", result.Missing)
+	list("Duplicated", result.Duplicated)
+	list("Reordered", result.Reordered)
+	report.line("Unexpected", "%d", result.Unexpected)
+	return report.err
+}
+
+func entriesSpan(entries []verifyEntry) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	return fmt.Sprintf(", from %s to %s", entries[0].Time.Format(time.RFC3339), entries[len(entries)-1].Time.Format(time.RFC3339))
+}
+
+// abbreviate returns the first line of s, shortened to at most n runes.
+func abbreviate(s string, n int) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n-1]) + "…"
+	}
+	return s
+}
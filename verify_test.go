@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/sha256"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+// verifyEvent returns an event as read back from a stream. Events of the
+// form "cursor:c1" hold that cursor, as when sent with include_cursor,
+// while others are matched by their hash.
+func verifyEvent(message string) verifyEntry {
+	if strings.HasPrefix(message, "cursor:") {
+		message = `{"cursor": "` + strings.TrimPrefix(message, "cursor:") + `", "message": "m"}`
+	}
+	return newEventEntry(&cloudwatchlogs.OutputLogEvent{
+		Message:   aws.String(message),
+		Timestamp: aws.Int64(1700000000000),
+	})
+}
+
+func TestCompareEvents(t *testing.T) {
+	// The entries' events are their names, and their cursors are c
+	// followed by their names.
+	tests := []struct {
+		name       string
+		entries    []string
+		events     []string
+		missing    string
+		duplicated string
+		reordered  string
+		unexpected int
+	}{
+		{
+			name:    "all there",
+			entries: []string{"a", "b", "c"},
+			events:  []string{"a", "b", "c"},
+		},
+		{
+			name:    "missing",
+			entries: []string{"a", "b", "c", "d"},
+			events:  []string{"a", "c"},
+			missing: "b d",
+		},
+		{
+			name:       "duplicated",
+			entries:    []string{"a", "b", "c"},
+			events:     []string{"a", "b", "b", "c", "b"},
+			duplicated: "b",
+		},
+		{
+			name:      "reordered",
+			entries:   []string{"a", "b", "c", "d"},
+			events:    []string{"a", "c", "b", "d"},
+			reordered: "b",
+		},
+		{
+			name:    "identical messages matched in turn",
+			entries: []string{"x", "x", "x"},
+			events:  []string{"x", "x"},
+			missing: "x",
+		},
+		{
+			name:       "identical messages sent too often",
+			entries:    []string{"x", "y", "x"},
+			events:     []string{"x", "y", "x", "x"},
+			duplicated: "x",
+		},
+		{
+			name:    "matched by cursor",
+			entries: []string{"a", "b", "c"},
+			events:  []string{"cursor:ca", "b", "cursor:cc"},
+		},
+		{
+			name:       "cursor rather than hash",
+			entries:    []string{"a", "b"},
+			events:     []string{"cursor:ca", "cursor:ca", "a"},
+			missing:    "b",
+			duplicated: "a",
+		},
+		{
+			name:       "outside the range",
+			entries:    []string{"b", "c"},
+			events:     []string{"a", "b", "c", "cursor:cd"},
+			unexpected: 2,
+		},
+		{
+			name:       "nothing sent",
+			entries:    []string{"a"},
+			events:     []string{"error report"},
+			missing:    "a",
+			unexpected: 1,
+		},
+	}
+
+	names := func(entries []verifyEntry) string {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Message)
+		}
+		return strings.Join(names, " ")
+	}
+
+	for _, test := range tests {
+		var entries, events []verifyEntry
+		for _, name := range test.entries {
+			entries = append(entries, verifyEntry{
+				Cursor:  "c" + name,
+				Hash:    sha256.Sum256([]byte(name)),
+				Message: name,
+			})
+		}
+		for _, message := range test.events {
+			events = append(events, verifyEvent(message))
+		}
+
+		result := compareEvents(entries, events)
+		if got := names(result.Missing); got != test.missing {
+			t.Errorf("%s: missing %q, want %q", test.name, got, test.missing)
+		}
+		if got := names(result.Duplicated); got != test.duplicated {
+			t.Errorf("%s: duplicated %q, want %q", test.name, got, test.duplicated)
+		}
+		if got := names(result.Reordered); got != test.reordered {
+			t.Errorf("%s: reordered %q, want %q", test.name, got, test.reordered)
+		}
+		if result.Unexpected != test.unexpected {
+			t.Errorf("%s: %d unexpected, want %d", test.name, result.Unexpected, test.unexpected)
+		}
+		ok := test.missing == "" && test.duplicated == "" && test.reordered == ""
+		if result.OK() != ok {
+			t.Errorf("%s: OK is %v", test.name, result.OK())
+		}
+	}
+}
+
+func TestNewEventEntry(t *testing.T) {
+	withCursor := verifyEvent(`{"cursor": "s=1;i=2", "message": "hello"}`)
+	if withCursor.Cursor != "s=1;i=2" || withCursor.Message != "hello" {
+		t.Errorf("got cursor %q and message %q", withCursor.Cursor, withCursor.Message)
+	}
+	if withCursor.Hash != ([sha256.Size]byte{}) {
+		t.Errorf("an event with a cursor was hashed")
+	}
+
+	for _, message := range []string{"plain text", `{"message": "no cursor"}`, "{not json"} {
+		entry := verifyEvent(message)
+		if entry.Cursor != "" || entry.Hash != sha256.Sum256([]byte(message)) {
+			t.Errorf("%q: not matched by the hash of the whole event", message)
+		}
+	}
+	if got := verifyEvent("x").Time.UnixNano(); got != 1700000000000*1e6 {
+		t.Errorf("time is %d", got)
+	}
+}
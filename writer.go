@@ -1,63 +1,247 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	awsSession "github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 )
 
+// maxBatchEvents is the most events that PutLogEvents accepts at once.
+const maxBatchEvents = 10000
+
+const (
+	// maxBatchBytes is the largest PutLogEvents request, counting the
+	// UTF-8 bytes of each event's message plus eventOverhead.
+	maxBatchBytes = 1048576
+
+	// maxEventBytes is the largest event, counted the same way. Larger
+	// events are truncated.
+	maxEventBytes = 262144
+
+	eventOverhead = 26
+)
+
+const (
+	// maxEventAge is the age beyond which Cloudwatch Logs rejects
+	// events, unless the log group's retention is shorter. Events a
+	// little younger than this are left out too, so that they don't
+	// become too old on their way.
+	maxEventAge    = 14 * 24 * time.Hour
+	eventAgeMargin = 10 * time.Minute
+
+	// maxBatchSpan is the longest time that the events in one
+	// PutLogEvents request may span.
+	maxBatchSpan = 24 * time.Hour
+)
+
 type Writer struct {
+	// mu guards the sequence token state, which is only changed by
+	// WriteBatch but may be read concurrently through SequenceToken.
+	mu sync.Mutex
+
 	conn              *cloudwatchlogs.CloudWatchLogs
 	logGroupName      string
 	logStreamName     string
 	nextSequenceToken string
+	useSequenceTokens bool
+	encode            Encoder
+
+	// maxAge is the age beyond which the log group rejects events,
+	// once it's been looked up.
+	maxAge time.Duration
 }
 
-func NewWriter(sess *awsSession.Session, logGroupName, logStreamName, firstSeqToken string) (*Writer, error) {
-	conn := cloudwatchlogs.New(sess)
+// expectedTokenPattern extracts the sequence token that Cloudwatch Logs
+// expects next from the message of an InvalidSequenceTokenException or
+// DataAlreadyAcceptedException.
+var expectedTokenPattern = regexp.MustCompile(`sequenceToken(?: is)?: (\S+)`)
+
+// NewWriter creates a writer for the given stream. Cloudwatch Logs no
+// longer requires sequence tokens, so unless useSequenceTokens is set the
+// writer doesn't send them, and only starts to if the service rejects a
+// request for lacking one.
+func NewWriter(conn *cloudwatchlogs.CloudWatchLogs, logGroupName, logStreamName, firstSeqToken, format string, useSequenceTokens bool) (*Writer, error) {
+	encode, err := GetEncoder(format)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Writer{
 		conn:              conn,
 		logGroupName:      logGroupName,
 		logStreamName:     logStreamName,
 		nextSequenceToken: firstSeqToken,
+		useSequenceTokens: useSequenceTokens,
+		encode:            encode,
 	}, nil
 }
 
-func (w *Writer) WriteBatch(records []Record) (string, error) {
+func (w *Writer) Name() string {
+	return "cloudwatch " + w.logGroupName + "/" + w.logStreamName
+}
+
+// SequenceToken returns the token to use for the next write to the stream,
+// which is persisted so that a restarted process can carry on writing.
+// It's always empty when the writer isn't using sequence tokens.
+func (w *Writer) SequenceToken() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.useSequenceTokens {
+		return ""
+	}
+	return w.nextSequenceToken
+}
+
+func (w *Writer) Close() error {
+	return nil
+}
+
+func (w *Writer) WriteBatch(records []Record) error {
+	name := w.Name()
 
 	events := make([]*cloudwatchlogs.InputLogEvent, 0, len(records))
-	for _, record := range records {
-		jsonDataBytes, err := json.MarshalIndent(record, "", "  ")
+	// Events are timestamped with their entry's time, so those read
+	// from far back in the journal, such as on the first start, may be
+	// too old for Cloudwatch Logs. They're left out rather than failing
+	// the whole request.
+	oldest := time.Now().Add(-w.maxEventAge() + eventAgeMargin)
+	sent := make([]*Record, 0, len(records))
+	truncated := 0
+	for i := range records {
+		record := &records[i]
+		if record.Time().Before(oldest) {
+			continue
+		}
+		data, err := w.encode(record)
 		if err != nil {
-			return "", err
+			return err
+		}
+		if len(data)+eventOverhead > maxEventBytes {
+			data = truncateUTF8(data, maxEventBytes-eventOverhead)
+			truncated++
 		}
-		jsonData := string(jsonDataBytes)
+		encodedBytesMetric.Add(float64(len(data)), name)
 
 		events = append(events, &cloudwatchlogs.InputLogEvent{
-			Message:   aws.String(jsonData),
+			Message:   aws.String(string(data)),
 			Timestamp: aws.Int64(int64(record.TimeUsec)),
 		})
+		sent = append(sent, record)
+	}
+	if dropped := len(records) - len(sent); dropped > 0 {
+		eventsRejectedMetric.Add(float64(dropped), name, "too_old")
+		log.Printf("%s: left out %d events older than the log group accepts", name, dropped)
+	}
+	if truncated > 0 {
+		eventsRejectedMetric.Add(float64(truncated), name, "too_large")
+		log.Printf("%s: truncated %d events larger than Cloudwatch Logs accepts", name, truncated)
+	}
+
+	for _, request := range splitEvents(events) {
+		err := w.writeEvents(request)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, record := range sent {
+		recordsShippedMetric.Add(1, name, record.SystemdUnit)
+	}
+	return nil
+}
+
+// splitEvents divides events into PutLogEvents requests. A request's
+// events must be in order and span no more than maxBatchSpan, which the
+// journal's entries needn't be, and there may only be so many of them,
+// of so many bytes.
+func splitEvents(events []*cloudwatchlogs.InputLogEvent) [][]*cloudwatchlogs.InputLogEvent {
+	var requests [][]*cloudwatchlogs.InputLogEvent
+	for len(events) > 0 {
+		n := 1
+		size := eventSize(events[0])
+		for n < len(events) && n < maxBatchEvents {
+			t := *events[n].Timestamp
+			if t < *events[n-1].Timestamp || t-*events[0].Timestamp > int64(maxBatchSpan/time.Millisecond) {
+				break
+			}
+			size += eventSize(events[n])
+			if size > maxBatchBytes {
+				break
+			}
+			n++
+		}
+		requests = append(requests, events[:n])
+		events = events[n:]
+	}
+	return requests
+}
+
+// eventSize returns the size of an event as counted towards the limits on
+// events and requests.
+func eventSize(event *cloudwatchlogs.InputLogEvent) int {
+	return len(*event.Message) + eventOverhead
+}
+
+// truncateUTF8 shortens data to at most n bytes, without splitting a UTF-8
+// encoded character.
+func truncateUTF8(data []byte, n int) []byte {
+	if len(data) <= n {
+		return data
+	}
+	for n > 0 && !utf8.RuneStart(data[n]) {
+		n--
+	}
+	return data[:n]
+}
+
+// maxEventAge returns the age beyond which the log group rejects events.
+// If it can't be looked up, Cloudwatch Logs' own limit is assumed, and
+// any events that the log group's retention rejects are reported.
+func (w *Writer) maxEventAge() time.Duration {
+	if w.maxAge == 0 {
+		maxAge, err := maxAcceptedAge(w.conn, w.logGroupName)
+		if err != nil {
+			log.Printf("unable to describe log group %s, so assuming it accepts events up to %s old: %s", w.logGroupName, maxEventAge, err)
+			maxAge = maxEventAge
+		}
+		w.maxAge = maxAge
 	}
+	return w.maxAge
+}
 
+func (w *Writer) writeEvents(events []*cloudwatchlogs.InputLogEvent) error {
 	putEvents := func() error {
 		request := &cloudwatchlogs.PutLogEventsInput{
 			LogEvents:     events,
 			LogGroupName:  &w.logGroupName,
 			LogStreamName: &w.logStreamName,
 		}
-		if w.nextSequenceToken != "" {
+		if w.useSequenceTokens && w.nextSequenceToken != "" {
 			request.SequenceToken = aws.String(w.nextSequenceToken)
 		}
+		start := time.Now()
 		result, err := w.conn.PutLogEvents(request)
+		putLatencyMetric.Observe(time.Since(start).Seconds(), w.Name())
 		if err != nil {
+			code := "Unknown"
+			if awsErr, ok := err.(awserr.Error); ok {
+				code = awsErr.Code()
+			}
+			putErrorsMetric.Add(1, w.Name(), code)
 			return err
 		}
-		w.nextSequenceToken = *result.NextSequenceToken
+		if result.NextSequenceToken != nil {
+			w.setSequenceToken(*result.NextSequenceToken)
+		}
+		w.reportRejected(events, result.RejectedLogEventsInfo)
 		return nil
 	}
 
@@ -79,42 +263,170 @@ func (w *Writer) WriteBatch(records []Record) (string, error) {
 				// writing the events again.
 				err := createStream()
 				if err != nil {
-					return "", fmt.Errorf("failed to create stream: %s", err)
+					return fmt.Errorf("failed to create stream: %s", err)
 				}
 
 				err = putEvents()
 				if err != nil {
-					return "", fmt.Errorf("failed to put events: %s", err)
+					return fmt.Errorf("failed to put events: %s", err)
 				}
-				return w.nextSequenceToken, nil
+				return nil
 			}
 			if awsErr.Code() == "DataAlreadyAcceptedException" {
-				// This batch was already sent
-				return "", nil
+				// This batch was already sent, so we just need to
+				// pick up the token for the next one.
+				if token, ok := expectedSequenceToken(awsErr); ok {
+					w.setSequenceToken(token)
+				}
+				return nil
 			}
 			if awsErr.Code() == "InvalidSequenceTokenException" {
-				request := &cloudwatchlogs.DescribeLogStreamsInput{
-					LogGroupName:        &w.logGroupName,
-					LogStreamNamePrefix: &w.logStreamName,
-					Descending:          aws.Bool(true),
-					Limit:               aws.Int64(1),
-				}
-				result, err := w.conn.DescribeLogStreams(request)
-				if err != nil {
-					return "", fmt.Errorf("failed to get next sequence token: %s", err)
+				if !w.useSequenceTokens {
+					// This endpoint still requires sequence tokens,
+					// so we'll have to use them from now on.
+					log.Printf("%s/%s requires sequence tokens", w.logGroupName, w.logStreamName)
+					w.mu.Lock()
+					w.useSequenceTokens = true
+					w.mu.Unlock()
 				}
 
-				w.nextSequenceToken = *(result.LogStreams[0].UploadSequenceToken)
+				token, ok := expectedSequenceToken(awsErr)
+				if !ok {
+					token, err = w.describeSequenceToken()
+					if err != nil {
+						return fmt.Errorf("failed to get next sequence token: %s", err)
+					}
+				}
+				w.setSequenceToken(token)
 
 				err = putEvents()
 				if err != nil {
-					return "", fmt.Errorf("failed to put events: %s", err)
+					return fmt.Errorf("failed to put events: %s", err)
 				}
-				return w.nextSequenceToken, nil
+				return nil
+			}
+		}
+		return fmt.Errorf("failed to put events: %s", err)
+	}
+
+	return nil
+}
+
+// reportRejected counts and logs the events of an accepted request that
+// Cloudwatch Logs didn't store, because they were too old or too new for
+// it, or older than the log group's retention.
+func (w *Writer) reportRejected(events []*cloudwatchlogs.InputLogEvent, info *cloudwatchlogs.RejectedLogEventsInfo) {
+	if info == nil {
+		return
+	}
+	report := func(reason string, count int64) {
+		if count <= 0 {
+			return
+		}
+		eventsRejectedMetric.Add(float64(count), w.Name(), reason)
+		log.Printf("%s: %d events were rejected as %s", w.Name(), count, strings.Replace(reason, "_", " ", -1))
+	}
+	if info.TooOldLogEventEndIndex != nil {
+		report("too_old", *info.TooOldLogEventEndIndex+1)
+	}
+	if info.ExpiredLogEventEndIndex != nil {
+		report("expired", *info.ExpiredLogEventEndIndex+1)
+	}
+	if info.TooNewLogEventStartIndex != nil {
+		report("too_new", int64(len(events))-*info.TooNewLogEventStartIndex)
+	}
+}
+
+// maxAcceptedAge returns the age beyond which the given log group rejects
+// events, which is its retention period if that's less than maxEventAge.
+func maxAcceptedAge(client *cloudwatchlogs.CloudWatchLogs, logGroupName string) (time.Duration, error) {
+	request := &cloudwatchlogs.DescribeLogGroupsInput{
+		LogGroupNamePrefix: &logGroupName,
+	}
+
+	var group *cloudwatchlogs.LogGroup
+	err := client.DescribeLogGroupsPages(request, func(page *cloudwatchlogs.DescribeLogGroupsOutput, lastPage bool) bool {
+		for _, g := range page.LogGroups {
+			if g.LogGroupName != nil && *g.LogGroupName == logGroupName {
+				group = g
+				return false
 			}
 		}
-		return "", fmt.Errorf("failed to put events: %s", err)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if group == nil {
+		return 0, fmt.Errorf("log group not found")
+	}
+
+	if group.RetentionInDays != nil {
+		retention := time.Duration(*group.RetentionInDays) * 24 * time.Hour
+		if retention < maxEventAge {
+			return retention, nil
+		}
+	}
+	return maxEventAge, nil
+}
+
+func (w *Writer) setSequenceToken(token string) {
+	w.mu.Lock()
+	w.nextSequenceToken = token
+	w.mu.Unlock()
+}
+
+// expectedSequenceToken returns the token given in a sequence token error.
+// The service reports "null" for a stream that hasn't been written to yet,
+// which we return as an empty token.
+func expectedSequenceToken(err awserr.Error) (string, bool) {
+	match := expectedTokenPattern.FindStringSubmatch(err.Message())
+	if match == nil {
+		return "", false
+	}
+	if match[1] == "null" {
+		return "", true
+	}
+	return match[1], true
+}
+
+// describeSequenceToken asks Cloudwatch Logs for the stream's next sequence
+// token.
+func (w *Writer) describeSequenceToken() (string, error) {
+	stream, err := describeStream(w.conn, w.logGroupName, w.logStreamName)
+	if err != nil {
+		return "", err
+	}
+	if stream == nil {
+		return "", fmt.Errorf("log stream %s not found", w.logStreamName)
+	}
+	if stream.UploadSequenceToken == nil {
+		return "", nil
+	}
+	return *stream.UploadSequenceToken, nil
+}
+
+// describeStream returns the description of the given stream, or nil if
+// it doesn't exist. The API can only filter by name prefix, so we must
+// look through the results for the stream whose name matches exactly.
+func describeStream(conn *cloudwatchlogs.CloudWatchLogs, logGroupName, logStreamName string) (*cloudwatchlogs.LogStream, error) {
+	request := &cloudwatchlogs.DescribeLogStreamsInput{
+		LogGroupName:        &logGroupName,
+		LogStreamNamePrefix: &logStreamName,
 	}
 
-	return w.nextSequenceToken, nil
+	var stream *cloudwatchlogs.LogStream
+	err := conn.DescribeLogStreamsPages(request, func(page *cloudwatchlogs.DescribeLogStreamsOutput, lastPage bool) bool {
+		for _, s := range page.LogStreams {
+			if s.LogStreamName != nil && *s.LogStreamName == logStreamName {
+				stream = s
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stream, nil
 }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+)
+
+func TestSplitEvents(t *testing.T) {
+	hour := int64(time.Hour / time.Millisecond)
+	event := func(timestamp int64, size int) *cloudwatchlogs.InputLogEvent {
+		return &cloudwatchlogs.InputLogEvent{
+			Message:   aws.String(strings.Repeat("x", size-eventOverhead)),
+			Timestamp: aws.Int64(timestamp),
+		}
+	}
+	repeat := func(n int, timestamp int64, size int) []*cloudwatchlogs.InputLogEvent {
+		var events []*cloudwatchlogs.InputLogEvent
+		for i := 0; i < n; i++ {
+			events = append(events, event(timestamp, size))
+		}
+		return events
+	}
+
+	tests := []struct {
+		name   string
+		events []*cloudwatchlogs.InputLogEvent
+		want   []int
+	}{
+		{"none", nil, nil},
+		{"one request", repeat(3, 0, 100), []int{3}},
+		{"out of order", []*cloudwatchlogs.InputLogEvent{event(2, 100), event(3, 100), event(1, 100), event(1, 100)}, []int{2, 2}},
+		{"a day apart", []*cloudwatchlogs.InputLogEvent{event(0, 100), event(24*hour, 100), event(24*hour+1, 100), event(30*hour, 100)}, []int{2, 2}},
+		{"too many events", repeat(maxBatchEvents+1, 0, 30), []int{maxBatchEvents, 1}},
+		{"too many bytes", repeat(5, 0, maxEventBytes), []int{4, 1}},
+		{"bytes just fit", repeat(8, 0, maxBatchBytes/4), []int{4, 4}},
+		{"bytes just over", repeat(8, 0, maxBatchBytes/4+1), []int{3, 3, 2}},
+	}
+
+	for _, test := range tests {
+		requests := splitEvents(test.events)
+		var got []int
+		for _, request := range requests {
+			got = append(got, len(request))
+			size := 0
+			for _, event := range request {
+				size += eventSize(event)
+			}
+			if size > maxBatchBytes {
+				t.Errorf("%s: a request has %d bytes", test.name, size)
+			}
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%s: got requests of %v events, want %v", test.name, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got requests of %v events, want %v", test.name, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		data string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"truncated", 5, "trunc"},
+		{"cafés", 4, "caf"},
+		{"cafés", 5, "café"},
+		{"日本", 2, ""},
+	}
+	for _, test := range tests {
+		got := string(truncateUTF8([]byte(test.data), test.n))
+		if got != test.want || !utf8.ValidString(got) {
+			t.Errorf("truncateUTF8(%q, %d) = %q, want %q", test.data, test.n, got, test.want)
+		}
+	}
+}